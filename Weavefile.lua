@@ -1,18 +1,27 @@
 -- This is a Weavefile for use with the `weave` tool.
+
+-- Failed commands fail the task unless called with { check = false }.
+config = {
+	strict = true,
+}
+
 task("build", { depends = { "test" }, help = "Builds and tests 'weave'." }, function(ctx)
 	ctx:run("go build -o weave ./cmd/weave/main.go")
 	ctx:notify("Weave", "weave has finished running build")
 end)
 
 task("rebuild", { depends = { "test" }, help = "Rebuilds weave, then tests it." }, function(ctx)
-	ctx:run("cp weave weave.old")
+	-- there is nothing to back up on a fresh checkout
+	local backup = ctx:run("cp weave weave.old", { check = false })
 
-	local r = ctx:run("go build -o weave ./cmd/weave/main.go")
+	local r = ctx:run("go build -o weave ./cmd/weave/main.go", { check = false })
 	if not r.ok then
-		ctx:run("mv weave.old weave")
-		ctx:log("error", "failed to build weave, restoring old weave")
-		ctx:log("error", "output", { error = r.err })
-	else
+		if backup.ok then
+			ctx:run("mv weave.old weave")
+			ctx:log("error", "failed to build weave, restoring old weave")
+		end
+		error("failed to build weave: " .. r.err)
+	elseif backup.ok then
 		ctx:run("rm weave.old")
 	end
 
@@ -20,13 +29,8 @@ task("rebuild", { depends = { "test" }, help = "Rebuilds weave, then tests it."
 end)
 
 task("test", { help = "Tests 'weave'." }, function(ctx)
-	local r = ctx:run("go test ./...")
-	if not r.ok then
-		ctx:log("error", "weave tests failed")
-		ctx:log("error", "output", { error = r.err })
-	else
-		ctx:log("info", "weave tests passed", { output = r.out })
-	end
+	ctx:run("go test ./...")
+	ctx:log("info", "weave tests passed")
 
 	ctx:notify("Weave", "weave has finished running tests")
 end)
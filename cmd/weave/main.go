@@ -5,7 +5,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/charmbracelet/log"
 	"github.com/pix-xip/go-command"
@@ -14,6 +20,10 @@ import (
 
 var Version string
 
+// exitCancelled is returned when a run is interrupted, matching the
+// conventional 128+SIGINT code used by shells.
+const exitCancelled = 130
+
 func main() {
 	r := command.Root().Help("Weave is a tool for executing Weavefile's").
 		Flags(func(f *flag.FlagSet) {
@@ -22,6 +32,15 @@ func main() {
 			f.String("log-format", "text", "set the log format [json|text]")
 			f.Bool("dry-run", false, "emit events without executing operations")
 			f.Int("workers", 2, "max parallel tasks to run")
+			f.Bool("fail-fast", false, "cancel running tasks as soon as one fails")
+			f.Bool("keep-going", false, "run every task whose dependencies succeeded")
+			f.Bool("strict", false, "fail the task when a command exits non-zero")
+			f.String("ssh-control-dir", "", "directory for shared ssh connection sockets")
+			f.String("inventory", "", "hosts and groups file, overrides config.inventory")
+			f.String("events-out", "", "write events as JSON Lines to a file, stdout, stderr or fd:N")
+			f.String("report", "", "write the run report to comma separated .json or .xml (JUnit) files")
+			f.Bool("no-history", false, "do not record the run under .weave/")
+			f.Bool("force", false, "run tasks with declared inputs and outputs even when up to date")
 
 			f.Bool("quiet", false, "disable all output")
 			f.Bool("debug", false, "enable debug mode")
@@ -30,7 +49,16 @@ func main() {
 	r.Action(cmdListTasks)
 
 	r.SubCommand("tasks").Action(cmdListTasks).Help("Lists all tasks in the Weavefile")
-	r.SubCommand("run").Action(cmdRunTask).Help("Run a specific weave task")
+	r.SubCommand("run").Action(cmdRunTask).
+		Help("Run weave tasks: run <task> [task ...] [key=value ...] [-- args ...]")
+
+	r.SubCommand("history").Action(cmdHistory).
+		Help("Lists recent runs: history [-n count]").
+		Flags(func(f *flag.FlagSet) {
+			f.Int("n", 20, "number of runs to list, 0 for all")
+		})
+	r.SubCommand("show").Action(cmdShowRun).
+		Help("Shows a recorded run and replays its output: show <run-id|last> [task]")
 
 	r.SubCommand("version").Help("Prints the version").
 		Action(func(ctx context.Context, fs *flag.FlagSet, args []string) error {
@@ -38,8 +66,19 @@ func main() {
 			return nil
 		})
 
-	if err := r.Execute(context.Background()); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	err := r.Execute(ctx)
+
+	stop()
+
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+
+		if errors.Is(err, context.Canceled) {
+			os.Exit(exitCancelled)
+		}
+
 		os.Exit(1)
 	}
 }
@@ -73,6 +112,15 @@ func makeOpts(fs *flag.FlagSet) (engine.Options, error) {
 		Quiet:      command.Lookup[bool](fs, "quiet"),
 		DryRun:     command.Lookup[bool](fs, "dry-run"),
 		MaxWorkers: command.Lookup[int](fs, "workers"),
+		FailFast:   command.Lookup[bool](fs, "fail-fast"),
+		KeepGoing:  command.Lookup[bool](fs, "keep-going"),
+		Strict:     command.Lookup[bool](fs, "strict"),
+
+		SSHControlDir: command.Lookup[string](fs, "ssh-control-dir"),
+		Inventory:     command.Lookup[string](fs, "inventory"),
+		Reports:       splitList(command.Lookup[string](fs, "report")),
+		NoHistory:     command.Lookup[bool](fs, "no-history"),
+		Force:         command.Lookup[bool](fs, "force"),
 	}, nil
 }
 
@@ -90,8 +138,12 @@ func cmdListTasks(ctx context.Context, fs *flag.FlagSet, args []string) error {
 
 	fmt.Println("Weavefile Tasks:")
 
-	for name, help := range eng.TaskNamesWithHelp() {
-		fmt.Printf("  - %s:\t%v\n", name, help)
+	for _, task := range eng.Tasks() {
+		fmt.Printf("  - %s:\t%v\n", task.Name, task.Help)
+
+		for _, p := range task.Params {
+			fmt.Printf("      %s\t%s\n", formatParam(p), p.Help)
+		}
 	}
 
 	fmt.Println()
@@ -105,21 +157,138 @@ func cmdRunTask(ctx context.Context, fs *flag.FlagSet, args []string) error {
 		return err
 	}
 
+	if spec := command.Lookup[string](fs, "events-out"); spec != "" {
+		out, err := openEventsOut(spec)
+		if err != nil {
+			return fmt.Errorf("events-out: %w", err)
+		}
+		defer out.Close()
+
+		opts.EventsOut = out
+	}
+
 	eng := engine.New(opts)
 
 	if err := eng.Load(); err != nil {
 		return fmt.Errorf("load error: %w", err)
 	}
 
-	if len(args) < 1 {
+	tasks, runArgs := parseRunArgs(args)
+	if len(tasks) < 1 {
 		return errors.New("missing task name")
 	}
 
-	taskName := args[0]
-
-	if err := eng.Run(taskName); err != nil {
+	if err := eng.Run(ctx, tasks, runArgs); err != nil {
 		return fmt.Errorf("run error: %w", err)
 	}
 
 	return nil
 }
+
+func cmdHistory(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	opts, err := makeOpts(fs)
+	if err != nil {
+		return err
+	}
+
+	return engine.New(opts).History(os.Stdout, command.Lookup[int](fs, "n"))
+}
+
+func cmdShowRun(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: show <run-id|last> [task]")
+	}
+
+	opts, err := makeOpts(fs)
+	if err != nil {
+		return err
+	}
+
+	task := ""
+	if len(args) == 2 {
+		task = args[1]
+	}
+
+	return engine.New(opts).ShowRun(os.Stdout, args[0], task)
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
+
+// openEventsOut opens the --events-out destination: "stdout", "stderr", an
+// already open file descriptor as "fd:N", or a file path to truncate.
+func openEventsOut(spec string) (io.WriteCloser, error) {
+	switch spec {
+	case "stdout", "-":
+		return nopCloser{os.Stdout}, nil
+	case "stderr":
+		return nopCloser{os.Stderr}, nil
+	}
+
+	if fd, ok := strings.CutPrefix(spec, "fd:"); ok {
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", fd)
+		}
+
+		return os.NewFile(uintptr(n), "fd:"+fd), nil
+	}
+
+	return os.Create(spec)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// parseRunArgs splits the run arguments into task names, key=value
+// parameters and the extra arguments following "--".
+func parseRunArgs(args []string) ([]string, engine.RunArgs) {
+	var tasks []string
+
+	out := engine.RunArgs{Params: map[string]string{}}
+
+	for i, arg := range args {
+		if arg == "--" {
+			out.Extra = append(out.Extra, args[i+1:]...)
+			break
+		}
+
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			if !slices.Contains(tasks, arg) {
+				tasks = append(tasks, arg)
+			}
+
+			continue
+		}
+
+		out.Params[key] = value
+	}
+
+	return tasks, out
+}
+
+func formatParam(p engine.ParamInfo) string {
+	details := []string{p.Type}
+
+	if p.Required {
+		details = append(details, "required")
+	}
+
+	if p.Default != "" {
+		details = append(details, "default "+p.Default)
+	}
+
+	return fmt.Sprintf("%s (%s)", p.Name, strings.Join(details, ", "))
+}
@@ -2,59 +2,192 @@ package engine
 
 import (
 	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
 type HostConfig struct {
-	Addr string
-	User string
+	Addr                  string
+	User                  string
+	Port                  int
+	IdentityFile          string
+	ProxyJump             string
+	StrictHostKeyChecking string            // "yes", "no" or "accept-new"
+	SSHOptions            map[string]string // passed as -o key=value
+	Multiplex             bool              // share a ControlMaster connection, on by default
+	Transport             string            // "ssh" (default) or "native"
+	FileTransfer          string            // "auto" (default), "rsync" or "tar"
+	Vars                  map[string]any    // free-form values for tasks
 }
 
-type Config struct {
-	Hosts map[string]HostConfig
+// Target returns the [user@]addr destination used by ssh and rsync.
+func (h HostConfig) Target() string {
+	if h.User == "" {
+		return h.Addr
+	}
+
+	return h.User + "@" + h.Addr
 }
 
-func loadConfigFrom(L *lua.LState) (Config, error) {
-	cfg := Config{}
+// SSHArgs returns the ssh flags for the host's connection settings, in a
+// stable order so ctx:run and rsync transports behave the same.
+func (h HostConfig) SSHArgs() []string {
+	args := []string{}
 
-	lv := L.GetGlobal("config")
-	if lv == lua.LNil {
-		return cfg, nil
+	if h.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(h.Port))
 	}
 
-	tbl, ok := lv.(*lua.LTable)
-	if !ok {
+	if h.IdentityFile != "" {
+		args = append(args, "-i", h.IdentityFile)
+	}
+
+	if h.ProxyJump != "" {
+		args = append(args, "-J", h.ProxyJump)
+	}
+
+	if h.StrictHostKeyChecking != "" {
+		args = append(args, "-o", "StrictHostKeyChecking="+h.StrictHostKeyChecking)
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(h.SSHOptions)) {
+		args = append(args, "-o", k+"="+h.SSHOptions[k])
+	}
+
+	return args
+}
+
+type Config struct {
+	Hosts         map[string]HostConfig
+	Groups        map[string][]string // group name to member host aliases
+	Strict        bool                // failed commands raise Lua errors unless called with check = false
+	Env           map[string]string
+	SSHMultiplex  bool   // share one ssh connection per host for a run, on by default
+	SSHControlDir string // where control sockets live, a temp dir when empty
+}
+
+// loadConfigFrom reads the config global, merging in inv when it is not
+// nil. Inline hosts and groups win over inventory ones of the same name.
+func loadConfigFrom(L *lua.LState, inv inventory) (Config, error) {
+	cfg := Config{SSHMultiplex: true}
+
+	tbl := L.NewTable()
+
+	switch lv := L.GetGlobal("config").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		tbl = lv
+	default:
 		return cfg, errors.New("config must be a table")
 	}
 
-	hosts, err := parseHosts(tbl)
+	hosts, err := parseHosts("config", tbl)
 	if err != nil {
 		return cfg, err
 	}
 
+	groups, err := parseGroups("config", tbl)
+	if err != nil {
+		return cfg, err
+	}
+
+	if inv != nil {
+		invTbl, _ := luaFromGo(L, inv).(*lua.LTable)
+
+		invHosts, err := parseHosts("inventory", invTbl)
+		if err != nil {
+			return cfg, err
+		}
+
+		invGroups, err := parseGroups("inventory", invTbl)
+		if err != nil {
+			return cfg, err
+		}
+
+		maps.Copy(invHosts, hosts)
+		maps.Copy(invGroups, groups)
+		hosts, groups = invHosts, invGroups
+	}
+
+	if err := checkGroups(groups, hosts); err != nil {
+		return cfg, err
+	}
+
+	applyGroupVars(hosts, groups)
+
 	if len(hosts) > 0 {
 		cfg.Hosts = hosts
 	}
 
+	if len(groups) > 0 {
+		cfg.Groups = map[string][]string{}
+		for name, g := range groups {
+			cfg.Groups[name] = g.hosts
+		}
+	}
+
+	if lv := tbl.RawGetString("env"); lv != lua.LNil {
+		env, err := luaEnv("config.env", lv)
+		if err != nil {
+			return cfg, err
+		}
+
+		cfg.Env = env
+	}
+
+	switch lv := tbl.RawGetString("strict").(type) {
+	case *lua.LNilType:
+	case lua.LBool:
+		cfg.Strict = bool(lv)
+	default:
+		return cfg, errors.New("config.strict must be a boolean")
+	}
+
+	switch lv := tbl.RawGetString("ssh_multiplex").(type) {
+	case *lua.LNilType:
+	case lua.LBool:
+		cfg.SSHMultiplex = bool(lv)
+	default:
+		return cfg, errors.New("config.ssh_multiplex must be a boolean")
+	}
+
+	switch lv := tbl.RawGetString("ssh_control_dir").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		cfg.SSHControlDir = expandHome(string(lv))
+	default:
+		return cfg, errors.New("config.ssh_control_dir must be a string")
+	}
+
 	return cfg, nil
 }
 
-func parseHosts(cfg *lua.LTable) (map[string]HostConfig, error) {
+// parseHosts reads the hosts table of cfg, with errors naming it as
+// src.hosts.
+func parseHosts(src string, cfg *lua.LTable) (map[string]HostConfig, error) {
+	hosts := map[string]HostConfig{}
+
 	lv := cfg.RawGetString("hosts")
 	if lv == lua.LNil {
-		return nil, errors.New("no valid hosts found")
+		return hosts, nil
 	}
 
 	hostsTbl, ok := lv.(*lua.LTable)
 	if !ok {
-		return nil, errors.New("config.hosts must be a table")
+		return nil, errors.New(src + ".hosts must be a table")
 	}
 
-	hosts := map[string]HostConfig{}
+	var err error
 
 	hostsTbl.ForEach(func(k, v lua.LValue) {
-		if k.Type() != lua.LTString {
+		if err != nil || k.Type() != lua.LTString {
 			return
 		}
 
@@ -65,24 +198,296 @@ func parseHosts(cfg *lua.LTable) (map[string]HostConfig, error) {
 
 		name := k.String()
 
-		host := HostConfig{
-			Addr: luaStringToString(hostTbl, "addr"),
-			User: luaStringToString(hostTbl, "user"),
-		}
-		if host.Addr == "" {
+		var host HostConfig
+
+		host, err = parseHost(src+".hosts."+name+".", hostTbl)
+		if err != nil || host.Addr == "" {
 			return
 		}
 
 		hosts[name] = host
 	})
 
+	if err != nil {
+		return nil, err
+	}
+
 	if len(hosts) == 0 && hostsTbl.Len() > 0 {
-		return nil, errors.New("config.hosts entries must be tables with at least addr")
+		return nil, errors.New(src + ".hosts entries must be tables with at least addr")
 	}
 
 	return hosts, nil
 }
 
+// groupDef is a parsed group: its member host aliases and the vars every
+// member inherits.
+type groupDef struct {
+	hosts []string
+	vars  map[string]any
+}
+
+// parseGroups reads the groups table of cfg. Each group is either a list of
+// host aliases or a table with hosts and vars. Members are checked by
+// checkGroups once every source of hosts is known.
+func parseGroups(src string, cfg *lua.LTable) (map[string]groupDef, error) {
+	groups := map[string]groupDef{}
+
+	lv := cfg.RawGetString("groups")
+	if lv == lua.LNil {
+		return groups, nil
+	}
+
+	groupsTbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return nil, errors.New(src + ".groups must be a table")
+	}
+
+	var err error
+
+	groupsTbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		name, ok := k.(lua.LString)
+		if !ok || name == "" {
+			err = errors.New(src + ".groups keys must be group names")
+			return
+		}
+
+		var g groupDef
+
+		g, err = parseGroup(src+".groups."+string(name), v)
+		if err != nil {
+			return
+		}
+
+		groups[string(name)] = g
+	})
+
+	return groups, err
+}
+
+func parseGroup(key string, v lua.LValue) (groupDef, error) {
+	tbl, ok := v.(*lua.LTable)
+	if !ok || tbl.Len() > 0 {
+		hosts, err := luaStringList(key, v)
+		return groupDef{hosts: hosts}, err
+	}
+
+	var (
+		g   groupDef
+		err error
+	)
+
+	tbl.ForEach(func(k, _ lua.LValue) {
+		if s, ok := k.(lua.LString); !ok || (s != "hosts" && s != "vars") {
+			err = fmt.Errorf("%s: unknown key %v, expected hosts or vars", key, k)
+		}
+	})
+
+	if err != nil {
+		return g, err
+	}
+
+	if g.hosts, err = luaStringList(key+".hosts", tbl.RawGetString("hosts")); err != nil {
+		return g, err
+	}
+
+	if lv := tbl.RawGetString("vars"); lv != lua.LNil {
+		if g.vars, ok = goFromLua(lv).(map[string]any); !ok {
+			return g, errors.New(key + ".vars must be a table of names to values")
+		}
+	}
+
+	return g, nil
+}
+
+// checkGroups reports group members that are not configured hosts.
+func checkGroups(groups map[string]groupDef, hosts map[string]HostConfig) error {
+	for _, name := range slices.Sorted(maps.Keys(groups)) {
+		for _, m := range groups[name].hosts {
+			if _, ok := hosts[m]; !ok {
+				return fmt.Errorf("groups.%s: unknown host %q", name, m)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyGroupVars folds group vars into the vars of each member host. Groups
+// are applied in name order, later ones winning, and a host's own vars win
+// over all of them.
+func applyGroupVars(hosts map[string]HostConfig, groups map[string]groupDef) {
+	names := slices.Sorted(maps.Keys(groups))
+
+	for alias, h := range hosts {
+		var merged map[string]any
+
+		for _, name := range names {
+			g := groups[name]
+			if len(g.vars) == 0 || !slices.Contains(g.hosts, alias) {
+				continue
+			}
+
+			if merged == nil {
+				merged = map[string]any{}
+			}
+
+			maps.Copy(merged, g.vars)
+		}
+
+		if merged == nil {
+			continue
+		}
+
+		maps.Copy(merged, h.Vars)
+		h.Vars = merged
+		hosts[alias] = h
+	}
+}
+
+// parseHost reads one host table, prefix names it in errors.
+func parseHost(prefix string, tbl *lua.LTable) (HostConfig, error) {
+	host := HostConfig{
+		Addr:         luaStringToString(tbl, "addr"),
+		User:         luaStringToString(tbl, "user"),
+		IdentityFile: expandHome(luaStringToString(tbl, "identity_file")),
+		ProxyJump:    luaStringToString(tbl, "proxy_jump"),
+		Multiplex:    true,
+	}
+
+	switch lv := tbl.RawGetString("transport").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		switch lv {
+		case transportSSH, transportNative:
+			host.Transport = string(lv)
+		default:
+			return host, errors.New(prefix + `transport must be "ssh" or "native"`)
+		}
+	default:
+		return host, errors.New(prefix + "transport must be a string")
+	}
+
+	switch lv := tbl.RawGetString("file_transfer").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		switch lv {
+		case transferAuto, transferRsync, transferTar:
+			host.FileTransfer = string(lv)
+		default:
+			return host, errors.New(prefix + `file_transfer must be "auto", "rsync" or "tar"`)
+		}
+	default:
+		return host, errors.New(prefix + "file_transfer must be a string")
+	}
+
+	switch lv := tbl.RawGetString("multiplex").(type) {
+	case *lua.LNilType:
+	case lua.LBool:
+		host.Multiplex = bool(lv)
+	default:
+		return host, errors.New(prefix + "multiplex must be a boolean")
+	}
+
+	switch lv := tbl.RawGetString("port").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		if lv <= 0 || lv > 65535 || float64(lv) != float64(int(lv)) {
+			return host, errors.New(prefix + "port must be a valid port number")
+		}
+
+		host.Port = int(lv)
+	default:
+		return host, errors.New(prefix + "port must be a number")
+	}
+
+	switch lv := tbl.RawGetString("strict_host_key_checking").(type) {
+	case *lua.LNilType:
+	case lua.LBool:
+		host.StrictHostKeyChecking = "no"
+		if lv {
+			host.StrictHostKeyChecking = "yes"
+		}
+	case lua.LString:
+		switch lv {
+		case "yes", "no", "accept-new":
+			host.StrictHostKeyChecking = string(lv)
+		default:
+			return host, errors.New(prefix + `strict_host_key_checking must be a boolean, "yes", "no" or "accept-new"`)
+		}
+	default:
+		return host, errors.New(prefix + "strict_host_key_checking must be a boolean or string")
+	}
+
+	if lv := tbl.RawGetString("ssh_options"); lv != lua.LNil {
+		opts, ok := lv.(*lua.LTable)
+		if !ok {
+			return host, errors.New(prefix + "ssh_options must be a table")
+		}
+
+		host.SSHOptions = map[string]string{}
+
+		var err error
+
+		opts.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+
+			key, ok := k.(lua.LString)
+			if !ok || key == "" {
+				err = errors.New(prefix + "ssh_options keys must be option names")
+				return
+			}
+
+			switch v := v.(type) {
+			case lua.LString, lua.LNumber:
+				host.SSHOptions[string(key)] = v.String()
+			case lua.LBool:
+				// ssh spells booleans yes and no
+				host.SSHOptions[string(key)] = "no"
+				if v {
+					host.SSHOptions[string(key)] = "yes"
+				}
+			default:
+				err = fmt.Errorf("%sssh_options.%s must be a string, number or boolean, got %s", prefix, key, v.Type())
+			}
+		})
+
+		if err != nil {
+			return host, err
+		}
+	}
+
+	if lv := tbl.RawGetString("vars"); lv != lua.LNil {
+		vars, ok := goFromLua(lv).(map[string]any)
+		if !ok {
+			return host, errors.New(prefix + "vars must be a table of names to values")
+		}
+
+		host.Vars = vars
+	}
+
+	return host, nil
+}
+
+// expandHome expands a leading ~/ to the current user's home directory.
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+
+	return filepath.Join(home, p[2:])
+}
+
 func luaStringToString(tbl *lua.LTable, key string) string {
 	lv := tbl.RawGetString(key)
 	if s, ok := lv.(lua.LString); ok {
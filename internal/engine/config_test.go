@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func loadTestConfig(t *testing.T, src string) (Config, error) {
+	t.Helper()
+
+	L := lua.NewState()
+	defer L.Close()
+
+	if err := L.DoString(src); err != nil {
+		t.Fatalf("DoString: %v", err)
+	}
+
+	return loadConfigFrom(L, nil)
+}
+
+func TestHostConfigSSHArgs(t *testing.T) {
+	cfg, err := loadTestConfig(t, `
+config = {
+  hosts = {
+    build = {
+      addr = "10.0.0.5",
+      user = "ci",
+      port = 2222,
+      identity_file = "/keys/ci",
+      proxy_jump = "bastion.example.com",
+      strict_host_key_checking = "accept-new",
+      ssh_options = { ServerAliveInterval = 30, Compression = true },
+    },
+    plain = { addr = "plain.example.com" },
+  },
+}
+`)
+	if err != nil {
+		t.Fatalf("loadConfigFrom: %v", err)
+	}
+
+	build := cfg.Hosts["build"]
+	if build.Target() != "ci@10.0.0.5" {
+		t.Fatalf("unexpected target %q", build.Target())
+	}
+
+	got := strings.Join(build.SSHArgs(), " ")
+	want := "-p 2222 -i /keys/ci -J bastion.example.com -o StrictHostKeyChecking=accept-new " +
+		"-o Compression=yes -o ServerAliveInterval=30"
+	if got != want {
+		t.Fatalf("ssh args mismatch:\ngot  %s\nwant %s", got, want)
+	}
+
+	if got := rsyncShell(build.SSHArgs()[:4]); got != "ssh '-p' '2222' '-i' '/keys/ci'" {
+		t.Fatalf("unexpected rsync shell %q", got)
+	}
+
+	plain := cfg.Hosts["plain"]
+	if plain.Target() != "plain.example.com" || len(plain.SSHArgs()) != 0 {
+		t.Fatalf("unexpected plain host %+v", plain)
+	}
+}
+
+func TestHostConfigValidation(t *testing.T) {
+	for _, src := range []string{
+		`config = { hosts = { a = { addr = "a", port = "22" } } }`,
+		`config = { hosts = { a = { addr = "a", port = 70000 } } }`,
+		`config = { hosts = { a = { addr = "a", strict_host_key_checking = "maybe" } } }`,
+		`config = { hosts = { a = { addr = "a", ssh_options = "x" } } }`,
+		`config = { hosts = { a = { addr = "a", ssh_options = { ProxyCommand = {} } } } }`,
+		`config = { hosts = { a = { addr = "a", ssh_options = { LogLevel = print } } } }`,
+		`config = { hosts = { a = { addr = "a" } }, groups = { web = { "a", "b" } } }`,
+		`config = { hosts = { a = { addr = "a" } }, groups = { web = "a" } }`,
+		`config = { hosts = { a = { addr = "a" } }, groups = { web = { hosts = { "a" }, bogus = 1 } } }`,
+		`config = { hosts = { a = { addr = "a", vars = { "x" } } } }`,
+	} {
+		if _, err := loadTestConfig(t, src); err == nil {
+			t.Fatalf("expected error for %s", src)
+		}
+	}
+}
+
+func TestReadInventory(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"hosts.toml": `
+[hosts.web1]
+addr = "10.0.1.1"
+port = 2222
+vars = { deploy_dir = "/srv/app" }
+
+[groups]
+web = ["web1"]
+`,
+		"hosts.yaml": `
+hosts:
+  web1:
+    addr: 10.0.1.1
+    port: 2222
+    vars:
+      deploy_dir: /srv/app
+groups:
+  web: [web1]
+`,
+		"hosts.json": `{
+  "hosts": { "web1": { "addr": "10.0.1.1", "port": 2222, "vars": { "deploy_dir": "/srv/app" } } },
+  "groups": { "web": ["web1"] }
+}`,
+		"hosts.sh": `#!/bin/sh
+echo '{"hosts": {"web1": {"addr": "10.0.1.1", "port": 2222, "vars": {"deploy_dir": "/srv/app"}}}, "groups": {"web": ["web1"]}}'
+`,
+	}
+
+	for name, src := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(src), 0o700); err != nil {
+				t.Fatalf("write inventory: %v", err)
+			}
+
+			inv, err := readInventory(path)
+			if err != nil {
+				t.Fatalf("readInventory: %v", err)
+			}
+
+			L := lua.NewState()
+			defer L.Close()
+
+			cfg, err := loadConfigFrom(L, inv)
+			if err != nil {
+				t.Fatalf("loadConfigFrom: %v", err)
+			}
+
+			web1 := cfg.Hosts["web1"]
+			if web1.Addr != "10.0.1.1" || web1.Port != 2222 || web1.Vars["deploy_dir"] != "/srv/app" {
+				t.Fatalf("unexpected host %+v", web1)
+			}
+
+			if got := strings.Join(cfg.Groups["web"], ","); got != "web1" {
+				t.Fatalf("unexpected web group %q", got)
+			}
+		})
+	}
+}
+
+func TestInventoryMergesWithInlineConfig(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	if err := L.DoString(`
+config = {
+  hosts = {
+    web1 = { addr = "override.example.com" },
+    local_box = { addr = "localhost" },
+  },
+  groups = { all = { "web1", "web2", "local_box" } },
+}
+`); err != nil {
+		t.Fatalf("DoString: %v", err)
+	}
+
+	inv := inventory{
+		"hosts": map[string]any{
+			"web1": map[string]any{"addr": "web1.example.com", "user": "deploy"},
+			"web2": map[string]any{"addr": "web2.example.com"},
+		},
+		"groups": map[string]any{"web": []any{"web1", "web2"}},
+	}
+
+	cfg, err := loadConfigFrom(L, inv)
+	if err != nil {
+		t.Fatalf("loadConfigFrom: %v", err)
+	}
+
+	if got := cfg.Hosts["web1"].Target(); got != "override.example.com" {
+		t.Fatalf("inline host should win, got %q", got)
+	}
+
+	if got := cfg.Hosts["web2"].Target(); got != "web2.example.com" {
+		t.Fatalf("unexpected inventory host %q", got)
+	}
+
+	if len(cfg.Groups["web"]) != 2 || len(cfg.Groups["all"]) != 3 {
+		t.Fatalf("unexpected groups %v", cfg.Groups)
+	}
+
+	if _, err := loadConfigFrom(L, inventory{"hosts": map[string]any{"x": map[string]any{"addr": "x", "port": "22"}}}); err == nil ||
+		!strings.Contains(err.Error(), "inventory.hosts.x.port") {
+		t.Fatalf("expected inventory port error, got %v", err)
+	}
+}
+
+func TestReadInventoryTimeout(t *testing.T) {
+	defer func(d time.Duration) { inventoryTimeout = d }(inventoryTimeout)
+	inventoryTimeout = 50 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "inventory.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 10\n"), 0o700); err != nil {
+		t.Fatalf("write inventory: %v", err)
+	}
+
+	start := time.Now()
+
+	_, err := readInventory(path)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("readInventory waited for the script to exit")
+	}
+}
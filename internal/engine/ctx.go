@@ -2,14 +2,18 @@
 package engine
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -19,43 +23,100 @@ import (
 )
 
 type Ctx struct {
-	L  *lua.LState
-	ud *lua.LUserData
-
-	bus    events.Emitter
-	cfg    Config
-	dryRun bool
+	L     *lua.LState
+	ud    *lua.LUserData
+	ctx   context.Context
+	index *lua.LTable
+
+	bus     events.Emitter
+	cfg     Config
+	dryRun  bool
+	strict  bool
+	task    string
+	runID   string
+	ops     *atomic.Uint64    // op ID counter shared by every task of a run
+	env     map[string]string // config and task level defaults
+	mux     *sshMux
+	clients *sshClientPool
+	rsync   *rsyncSupport
 }
 
-func NewCtx(L *lua.LState, bus events.Emitter) *Ctx {
+func NewCtx(ctx context.Context, L *lua.LState, bus events.Emitter) *Ctx {
 	c := &Ctx{
 		L:   L,
+		ctx: ctx,
 		bus: bus,
+		ops: new(atomic.Uint64),
 	}
 	ud := L.NewUserData()
 	ud.Value = c
 	c.ud = ud
 
 	meta := L.NewTypeMetatable("weave_ctx")
-	L.SetField(meta, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+	c.index = L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"run":    c.luaRun,
 		"sync":   c.luaSync,
 		"fetch":  c.luaFetch,
 		"log":    c.luaLog,
 		"notify": c.luaNotify,
-	}))
+		"host":   c.luaHost,
+
+		"read_file":  c.luaReadFile,
+		"write_file": c.luaWriteFile,
+		"put":        c.luaPut,
+		"get":        c.luaGet,
+		"template":   c.luaTemplate,
+	})
+	L.SetField(c.index, "params", L.NewTable())
+	L.SetField(c.index, "args", L.NewTable())
+	L.SetField(meta, "__index", c.index)
 
 	L.SetMetatable(ud, meta)
 
 	return c
 }
 
-// ctx:run("echo hi") -> { ok=true, code=0, out="...", err="..." }
+// newOpID returns the ID correlating the events of a new op.
+func (c *Ctx) newOpID() string {
+	return strconv.FormatUint(c.ops.Add(1), 10)
+}
+
+// emit publishes an event on behalf of the task owning c. opID is empty
+// for events that do not belong to an op.
+func (c *Ctx) emit(typ events.Type, opID string, fields map[string]any) {
+	c.bus.Emit(events.Event{
+		Type:   typ,
+		Time:   time.Now(),
+		Task:   c.task,
+		RunID:  c.runID,
+		OpID:   opID,
+		Fields: fields,
+	})
+}
+
+// setInvocation exposes the run parameters and extra command line arguments
+// to Lua as ctx.params and ctx.args.
+func (c *Ctx) setInvocation(params map[string]any, args []string) {
+	ptbl := c.L.NewTable()
+	for k, v := range params {
+		ptbl.RawSetString(k, toLuaValue(v))
+	}
+
+	atbl := c.L.NewTable()
+	for _, a := range args {
+		atbl.Append(lua.LString(a))
+	}
+
+	c.L.SetField(c.index, "params", ptbl)
+	c.L.SetField(c.index, "args", atbl)
+}
+
+// ctx:run("echo hi") -> { ok=true, code=0, out="...", err="...", attempts=1, timed_out=false }
 func (c *Ctx) luaRun(L *lua.LState) int {
 	// method call: arg1 is userdata, arg2 is first user arg
-	top := L.GetTop()
+	optsTbl, top := trailingOptions(L)
 	if top < 2 || top > 3 {
-		L.ArgError(2, "expected ctx:run(cmd) or ctx:run(host, cmd)")
+		L.ArgError(2, "expected ctx:run(cmd[, opts]) or ctx:run(host, cmd[, opts])")
 		return 1
 	}
 
@@ -70,106 +131,212 @@ func (c *Ctx) luaRun(L *lua.LState) int {
 		cmdstr = L.CheckString(3)
 	}
 
-	var cmd *exec.Cmd
+	if group, ok := strings.CutPrefix(hostname, "@"); ok {
+		return c.luaRunGroup(L, group, cmdstr, optsTbl, top+1)
+	}
 
-	// use a shell for convenience initially
-	if hostname == "" {
-		// support only those with 'sh'
-		cmd = exec.CommandContext(context.Background(), "sh", "-lc", cmdstr)
-	} else {
-		host, ok := c.cfg.Hosts[hostname]
+	opts, err := parseOpOptions(optsTbl, runOpKeys)
+	if err != nil {
+		L.ArgError(top+1, err.Error())
+		return 1
+	}
+
+	var host *HostConfig
+
+	if hostname != "" {
+		h, ok := c.cfg.Hosts[hostname]
 		if !ok {
 			L.ArgError(2, "unknown host: "+hostname)
 			return 1
 		}
 
-		target := host.Addr
-		if host.User != "" {
-			target = host.User + "@" + host.Addr
+		host = &h
+
+		if opts.interpolate {
+			if cmdstr, err = interpolate(cmdstr, hostVars(hostname, h), false); err != nil {
+				L.ArgError(3, err.Error())
+				return 1
+			}
 		}
+	}
+
+	res := c.runCommand(hostname, host, cmdstr, opts)
+
+	c.checkResult(L, opts, "run", hostname, cmdstr, res)
+	pushCmdResult(L, res)
+
+	return 1
+}
+
+// runCommand runs cmdstr locally, or on host when it is set, emitting the
+// op events. It does not touch the Lua state so it is safe to call from
+// several goroutines at once.
+func (c *Ctx) runCommand(hostname string, host *HostConfig, cmdstr string, opts opOptions) cmdResult {
+	env := mergeEnv(c.env, opts.env)
 
-		remoteCmd := "sh -lc " + shellQuotePosix(cmdstr)
-		cmd = exec.CommandContext(context.Background(), "ssh", target, "--", remoteCmd)
+	var attempt attemptFunc
+
+	// use a shell for convenience initially
+	if host == nil {
+		// support only those with 'sh'
+		attempt = execAttemptIn(opts.cwd, env, "sh", "-lc", cmdstr)
+	} else {
+		remoteCmd := "sh -lc " + shellQuotePosix(remoteScript(env, opts.cwd, cmdstr))
+		tr := c.transport(*host)
+		attempt = func(ctx context.Context, stdout, stderr io.Writer) error {
+			return tr.Run(ctx, remoteCmd, nil, stdout, stderr)
+		}
 	}
 
 	start := time.Now()
+	opID := c.newOpID()
 
-	c.bus.Emit(events.Event{
-		Type:   events.OpStart,
-		Time:   time.Now(),
-		Task:   "run",
-		Fields: map[string]any{"op": "run", "host": hostname, "cmd": cmdstr, "dry_run": c.dryRun},
-	})
+	c.emit(events.OpStart, opID, map[string]any{"op": "run", "host": hostname, "cmd": cmdstr, "dry_run": c.dryRun})
 
 	if c.dryRun {
-		c.bus.Emit(events.Event{
-			Type: events.OpEnd,
-			Time: time.Now(),
-			Task: "run",
-			Fields: map[string]any{
-				"op":          "run",
-				"host":        hostname,
-				"ok":          true,
-				"code":        0,
-				"duration_ms": time.Since(start).Milliseconds(),
-				"dry_run":     true,
-			},
+		c.emit(events.OpEnd, opID, map[string]any{
+			"op":          "run",
+			"host":        hostname,
+			"ok":          true,
+			"code":        0,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"attempts":    0,
+			"dry_run":     true,
 		})
 
-		res := L.NewTable()
+		return cmdResult{}
+	}
 
-		L.SetField(res, "ok", lua.LBool(true))
-		L.SetField(res, "code", lua.LNumber(0))
-		L.SetField(res, "out", lua.LString(""))
-		L.SetField(res, "err", lua.LString(""))
-		L.Push(res)
+	res := runWithRetry(c.ctx, opts, attempt, c.lineSink(opts, opID, "run", hostname))
 
-		return 1
+	dur := time.Since(start)
+	c.emit(events.OpEnd, opID, map[string]any{
+		"op":          "run",
+		"host":        hostname,
+		"ok":          res.ok(),
+		"code":        res.code,
+		"duration_ms": dur.Milliseconds(),
+		"stdout_len":  len(res.stdout),
+		"stderr_len":  len(res.stderr),
+		"attempts":    res.attempts,
+		"timed_out":   res.timedOut,
+		"dry_run":     false,
+	})
+
+	return res
+}
+
+// stderrTailLines bounds how much stderr is quoted in a strict mode error.
+const stderrTailLines = 20
+
+// checkResult raises a Lua error for a failed command when strict mode is on
+// or the call asked for it with check = true.
+func (c *Ctx) checkResult(L *lua.LState, opts opOptions, op, host, cmdstr string, res cmdResult) {
+	check := c.strict
+	if opts.check != nil {
+		check = *opts.check
 	}
 
-	var stdout, stderr bytes.Buffer
+	if !check || res.ok() {
+		return
+	}
 
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	where := "locally"
+	if host != "" {
+		where = "on " + host
+	}
 
-	err := cmd.Run()
-	code := 0
+	msg := fmt.Sprintf("%s failed %s (exit %d): %s", op, where, res.code, cmdstr)
+	if tail := tailLines(res.stderr, stderrTailLines); tail != "" {
+		msg += "\n" + tail
+	}
 
-	if err != nil {
-		// best-effort exit code extraction:
-		if ee, ok := errors.AsType[*exec.ExitError](err); ok {
-			code = ee.ExitCode()
-		} else {
-			code = 1
-		}
+	L.RaiseError("%s", msg)
+}
+
+func tailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
 	}
 
-	dur := time.Since(start)
-	c.bus.Emit(events.Event{
-		Type: events.OpEnd,
-		Time: time.Now(),
-		Task: "run",
-		Fields: map[string]any{
-			"op":          "run",
-			"host":        hostname,
-			"ok":          err == nil,
-			"code":        code,
-			"duration_ms": dur.Milliseconds(),
-			"stdout_len":  len(stdout.String()),
-			"stderr_len":  len(stderr.String()),
-			"dry_run":     false,
-		},
-	})
+	return strings.Join(lines, "\n")
+}
+
+// lineSink publishes each line of command output on the bus as it is
+// produced, unless streaming was turned off for the call.
+func (c *Ctx) lineSink(opts opOptions, opID, op, host string) lineFunc {
+	if !opts.stream {
+		return nil
+	}
 
-	res := L.NewTable()
+	prefix := streamPrefix(c.task, host)
 
-	L.SetField(res, "ok", lua.LBool(err == nil))
-	L.SetField(res, "code", lua.LNumber(code))
-	L.SetField(res, "out", lua.LString(stdout.String()))
-	L.SetField(res, "err", lua.LString(stderr.String()))
-	L.Push(res)
+	return func(stream, line string) {
+		c.emit(events.Output, opID, map[string]any{
+			"op":     op,
+			"host":   host,
+			"stream": stream,
+			"line":   line,
+			"prefix": prefix,
+		})
+	}
+}
 
-	return 1
+// trailingOptions pops an optional options table off the end of the
+// arguments, returning it and the number of remaining arguments.
+func trailingOptions(L *lua.LState) (*lua.LTable, int) {
+	top := L.GetTop()
+	if top < 2 {
+		return nil, top
+	}
+
+	if tbl, ok := L.Get(top).(*lua.LTable); ok {
+		return tbl, top - 1
+	}
+
+	return nil, top
+}
+
+func pushCmdResult(L *lua.LState, res cmdResult) {
+	L.Push(cmdResultTable(L, res))
+}
+
+func cmdResultTable(L *lua.LState, res cmdResult) *lua.LTable {
+	tbl := L.NewTable()
+
+	L.SetField(tbl, "ok", lua.LBool(res.ok()))
+	L.SetField(tbl, "code", lua.LNumber(res.code))
+	L.SetField(tbl, "out", lua.LString(res.stdout))
+	L.SetField(tbl, "err", lua.LString(res.stderr))
+	L.SetField(tbl, "attempts", lua.LNumber(res.attempts))
+	L.SetField(tbl, "timed_out", lua.LBool(res.timedOut))
+
+	return tbl
+}
+
+// remoteScript prepends exports for env and a cd into cwd to cmdstr, so they
+// apply inside the remote login shell after its profile has been read.
+func remoteScript(env map[string]string, cwd, cmdstr string) string {
+	var b strings.Builder
+
+	if len(env) > 0 {
+		b.WriteString("export")
+
+		for _, k := range slices.Sorted(maps.Keys(env)) {
+			b.WriteString(" " + k + "=" + shellQuotePosix(env[k]))
+		}
+
+		b.WriteString("\n")
+	}
+
+	if cwd != "" {
+		b.WriteString("cd " + shellQuotePosix(cwd) + " || exit 1\n")
+	}
+
+	b.WriteString(cmdstr)
+
+	return b.String()
 }
 
 func shellQuotePosix(s string) string {
@@ -198,15 +365,10 @@ func (c *Ctx) luaLog(L *lua.LState) int {
 		})
 	}
 
-	c.bus.Emit(events.Event{
-		Type: events.Message,
-		Time: time.Now(),
-		Task: "log",
-		Fields: map[string]any{
-			"level": level,
-			"msg":   msg,
-			"attrs": attrs,
-		},
+	c.emit(events.Message, "", map[string]any{
+		"level": level,
+		"msg":   msg,
+		"attrs": attrs,
 	})
 
 	return 0
@@ -224,132 +386,180 @@ func (c *Ctx) luaNotify(L *lua.LState) int {
 	return 0
 }
 
-// ctx:sync(src, dst) -> { ok=true, code=0, out="", err="" }
+// ctx:sync(src, dst[, opts]) -> { ok=true, code=0, out="", err="", attempts=1, timed_out=false[, changes={...}] }
 func (c *Ctx) luaSync(L *lua.LState) int {
-	src := L.CheckString(2)
-	dst := L.CheckString(3)
-
-	return c.luaRsync(L, "sync", src, dst)
+	return c.luaRsync(L, "sync")
 }
 
-// ctx:fetch(src, dst) -> { ok=true, code=0, out="", err="" }
+// ctx:fetch(src, dst[, opts]) -> { ok=true, code=0, out="", err="", attempts=1, timed_out=false[, changes={...}] }
 func (c *Ctx) luaFetch(L *lua.LState) int {
+	return c.luaRsync(L, "fetch")
+}
+
+func (c *Ctx) luaRsync(L *lua.LState, op string) int {
 	src := L.CheckString(2)
 	dst := L.CheckString(3)
 
-	return c.luaRsync(L, "fetch", src, dst)
-}
-
-func (c *Ctx) luaRsync(L *lua.LState, op, src, dst string) int {
-	resolvedSrc, err := c.resolveRsyncPath(src)
+	opts, err := parseOpOptions(L.OptTable(4, nil), rsyncOpKeys)
 	if err != nil {
-		return c.luaRsyncError(L, err)
+		L.ArgError(4, err.Error())
+		return 1
 	}
 
-	resolvedDst, err := c.resolveRsyncPath(dst)
+	paths, err := c.interpolateHostPaths(opts, src, dst)
 	if err != nil {
-		return c.luaRsyncError(L, err)
+		L.ArgError(2, err.Error())
+		return 1
+	}
+
+	src, dst = paths[0], paths[1]
+
+	resolvedSrc, srcHost := c.resolveRsyncPath(src)
+	resolvedDst, dstHost := c.resolveRsyncPath(dst)
+
+	if srcHost != nil && dstHost != nil {
+		return c.luaRsyncError(L, opts, op, errors.New("rsync cannot copy between two remote hosts"))
+	}
+
+	host := srcHost
+	if host == nil {
+		host = dstHost
+	}
+
+	method := transferMethod(host)
+	if method == transferTar {
+		if err := checkTarOptions(opts.rsync); err != nil {
+			return c.luaRsyncError(L, opts, op, err)
+		}
 	}
 
 	start := time.Now()
-	c.bus.Emit(events.Event{
-		Type:   events.OpStart,
-		Time:   time.Now(),
-		Task:   op,
-		Fields: map[string]any{"op": op, "src": src, "dst": dst, "dry_run": c.dryRun},
-	})
+	opID := c.newOpID()
+
+	c.emit(events.OpStart, opID, map[string]any{"op": op, "src": src, "dst": dst, "dry_run": c.dryRun || opts.rsync.dryRun})
 
 	if c.dryRun {
-		c.bus.Emit(events.Event{
-			Type: events.OpEnd,
-			Time: time.Now(),
-			Task: op,
-			Fields: map[string]any{
-				"op":          op,
-				"ok":          true,
-				"code":        0,
-				"duration_ms": time.Since(start).Milliseconds(),
-				"dry_run":     true,
-			},
+		c.emit(events.OpEnd, opID, map[string]any{
+			"op":          op,
+			"src":         src,
+			"dst":         dst,
+			"ok":          true,
+			"code":        0,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"attempts":    0,
+			"dry_run":     true,
 		})
 
-		res := L.NewTable()
-
-		L.SetField(res, "ok", lua.LBool(true))
-		L.SetField(res, "code", lua.LNumber(0))
-		L.SetField(res, "out", lua.LString(""))
-		L.SetField(res, "err", lua.LString(""))
-		L.Push(res)
+		pushCmdResult(L, cmdResult{})
 
 		return 1
 	}
 
-	if err := ensureLocalDest(resolvedDst); err != nil {
-		return c.luaRsyncError(L, err)
+	// a preview must not leave directories behind
+	if !opts.rsync.dryRun {
+		if err := ensureLocalDest(resolvedDst); err != nil {
+			return c.luaRsyncError(L, opts, op, err)
+		}
 	}
 
-	args := []string{"-az", "--delete"}
-	if rsyncPath := rsyncPathWithMkdir(resolvedDst); rsyncPath != "" {
-		args = append(args, "--rsync-path", rsyncPath)
-	}
+	var (
+		res     cmdResult
+		cmdDesc string
+	)
 
-	args = append(args, resolvedSrc, resolvedDst)
-	log.Debugf("executing: rsync %s", strings.Join(args, " "))
-	cmd := exec.CommandContext(context.Background(), "rsync", args...)
+	if method == transferRsync {
+		res, cmdDesc = c.runRsync(opID, op, src, dst, resolvedSrc, resolvedDst, host, opts)
 
-	var stdout, stderr bytes.Buffer
+		// auto mode falls back to tar when the remote end lacks rsync
+		if remoteRsyncMissing(res) && (host == nil || host.FileTransfer == "" || host.FileTransfer == transferAuto) &&
+			checkTarOptions(opts.rsync) == nil {
+			log.Debug("rsync missing on remote host, falling back to tar", "op", op)
 
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+			method = transferTar
+		}
+	}
 
-	err = cmd.Run()
-	code := 0
+	if method == transferTar {
+		cmdDesc = "tar " + resolvedSrc + " -> " + resolvedDst
+		res = runWithRetry(c.ctx, opts, c.tarAttempt(resolvedSrc, resolvedDst, host), c.lineSink(opts, opID, op, ""))
+	}
 
-	if err != nil {
-		if ee, ok := errors.AsType[*exec.ExitError](err); ok {
-			code = ee.ExitCode()
-		} else {
-			code = 1
-		}
+	var changes []rsyncChange
+	if opts.rsync.dryRun {
+		changes = parseItemizedChanges(res.stdout)
 	}
 
-	dur := time.Since(start)
-	c.bus.Emit(events.Event{
-		Type: events.OpEnd,
-		Time: time.Now(),
-		Task: op,
-		Fields: map[string]any{
-			"op":          op,
-			"ok":          err == nil,
-			"code":        code,
-			"duration_ms": dur.Milliseconds(),
-			"dry_run":     false,
-		},
-	})
+	fields := map[string]any{
+		"op":          op,
+		"src":         src,
+		"dst":         dst,
+		"ok":          res.ok(),
+		"code":        res.code,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"attempts":    res.attempts,
+		"timed_out":   res.timedOut,
+		"dry_run":     opts.rsync.dryRun,
+		"transfer":    method,
+	}
+	if opts.rsync.dryRun {
+		fields["changes"] = len(changes)
+	}
 
-	errStr := ""
-	if err != nil {
-		errStr = stderr.String()
+	c.emit(events.OpEnd, opID, fields)
+
+	if res.ok() {
+		res.stderr = ""
 	}
 
-	res := L.NewTable()
+	c.checkResult(L, opts, op, "", cmdDesc, res)
 
-	L.SetField(res, "ok", lua.LBool(err == nil))
-	L.SetField(res, "code", lua.LNumber(code))
-	L.SetField(res, "out", lua.LString(stdout.String()))
-	L.SetField(res, "err", lua.LString(errStr))
-	L.Push(res)
+	tbl := cmdResultTable(L, res)
+	if opts.rsync.dryRun {
+		L.SetField(tbl, "changes", rsyncChangesTable(L, changes))
+	}
+
+	L.Push(tbl)
 
 	return 1
 }
 
-func (c *Ctx) luaRsyncError(L *lua.LState, err error) int {
-	res := L.NewTable()
-	L.SetField(res, "ok", lua.LBool(false))
-	L.SetField(res, "code", lua.LNumber(1))
-	L.SetField(res, "out", lua.LString(""))
-	L.SetField(res, "err", lua.LString(err.Error()))
-	L.Push(res)
+// runRsync runs rsync for ctx:sync or ctx:fetch, returning the result and
+// the command line for error messages.
+func (c *Ctx) runRsync(opID, op, src, dst, resolvedSrc, resolvedDst string, host *HostConfig, opts opOptions) (cmdResult, string) {
+	// old rsync rejects --info=progress2, so those transfers go without
+	if opts.rsync.progress && !opts.rsync.dryRun && !c.rsync.hasProgress(c.ctx) {
+		opts.rsync.progress = false
+	}
+
+	args := rsyncFlags(op, opts.rsync)
+	if host != nil {
+		if sshArgs := c.mux.sshArgs(*host); len(sshArgs) > 0 {
+			args = append(args, "-e", rsyncShell(sshArgs))
+		}
+	}
+
+	if rsyncPath := rsyncPathWithMkdir(resolvedDst); rsyncPath != "" {
+		args = append(args, "--rsync-path", rsyncPath)
+	}
+
+	args = append(args, resolvedSrc, resolvedDst)
+	log.Debugf("executing: rsync %s", strings.Join(args, " "))
+
+	attempt := execAttempt("rsync", args...)
+	if opts.rsync.progress && !opts.rsync.dryRun {
+		attempt = c.withRsyncProgress(attempt, opID, op, src, dst)
+	}
+
+	res := runWithRetry(c.ctx, opts, attempt, c.lineSink(opts, opID, op, ""))
+
+	return res, "rsync " + strings.Join(args, " ")
+}
+
+func (c *Ctx) luaRsyncError(L *lua.LState, opts opOptions, op string, err error) int {
+	res := cmdResult{code: 1, err: err, stderr: err.Error()}
+
+	c.checkResult(L, opts, op, "", "rsync", res)
+	pushCmdResult(L, res)
 
 	return 1
 }
@@ -383,7 +593,9 @@ func mkdirAll(dirpath string) error {
 	return os.MkdirAll(dirpath, 0o750)
 }
 
-func (c *Ctx) resolveRsyncPath(rpath string) (string, error) {
+// resolveRsyncPath rewrites a host:path spec that names a configured host
+// alias to the host's real target, returning the host it refers to.
+func (c *Ctx) resolveRsyncPath(rpath string) (string, *HostConfig) {
 	host, remotePath, ok := splitHostPath(rpath)
 	if !ok {
 		return rpath, nil
@@ -394,12 +606,55 @@ func (c *Ctx) resolveRsyncPath(rpath string) (string, error) {
 		return rpath, nil
 	}
 
-	target := hostCfg.Addr
-	if hostCfg.User != "" {
-		target = hostCfg.User + "@" + hostCfg.Addr
+	return hostCfg.Target() + ":" + remotePath, &hostCfg
+}
+
+// interpolateHostPaths fills placeholders in every path from the vars of
+// the first configured host one of them names, unless opts turn
+// interpolation off. Purely local paths are left as is.
+func (c *Ctx) interpolateHostPaths(opts opOptions, paths ...string) ([]string, error) {
+	if !opts.interpolate {
+		return paths, nil
+	}
+
+	for _, p := range paths {
+		alias, _, ok := splitHostPath(p)
+		if !ok {
+			continue
+		}
+
+		host, ok := c.cfg.Hosts[alias]
+		if !ok {
+			continue
+		}
+
+		vars := hostVars(alias, host)
+		out := make([]string, len(paths))
+
+		for i, q := range paths {
+			var err error
+
+			if out[i], err = interpolate(q, vars, false); err != nil {
+				return nil, err
+			}
+		}
+
+		return out, nil
+	}
+
+	return paths, nil
+}
+
+// rsyncShell builds the -e transport for rsync from a host's ssh flags.
+func rsyncShell(sshArgs []string) string {
+	parts := make([]string, 0, len(sshArgs)+1)
+	parts = append(parts, "ssh")
+
+	for _, a := range sshArgs {
+		parts = append(parts, shellQuotePosix(a))
 	}
 
-	return target + ":" + remotePath, nil
+	return strings.Join(parts, " ")
 }
 
 func splitHostPath(hpath string) (string, string, bool) {
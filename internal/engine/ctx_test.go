@@ -0,0 +1,15 @@
+package engine
+
+import "testing"
+
+func TestRemoteScript(t *testing.T) {
+	got := remoteScript(map[string]string{"B": "it's", "A": "1"}, "/srv/app dir", "make && ls")
+	want := "export A='1' B='it'\\''s'\ncd '/srv/app dir' || exit 1\nmake && ls"
+	if got != want {
+		t.Fatalf("remoteScript mismatch:\ngot  %q\nwant %q", got, want)
+	}
+
+	if got := remoteScript(nil, "", "true"); got != "true" {
+		t.Fatalf("expected bare command, got %q", got)
+	}
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around a change.
+	diffContext = 3
+	// diffMaxCells bounds the LCS table, larger inputs are shown as a full
+	// replacement.
+	diffMaxCells = 4_000_000
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+	a, b int // line positions in the old and new text before this op
+}
+
+// unifiedDiff returns a unified diff turning before into after, or "" when
+// they are equal.
+func unifiedDiff(from, to string, before, after []byte) string {
+	if bytes.Equal(before, after) {
+		return ""
+	}
+
+	if bytes.IndexByte(before, 0) >= 0 || bytes.IndexByte(after, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s and %s differ\n", from, to)
+	}
+
+	ops := diffLines(splitLines(string(before)), splitLines(string(after)))
+
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", from, to)
+
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+
+		if i == len(ops) {
+			break
+		}
+
+		// grow the hunk while the next change is close enough to share context
+		end := i
+		for k := i; k < len(ops) && k-end <= 2*diffContext; k++ {
+			if ops[k].kind != ' ' {
+				end = k
+			}
+		}
+
+		start := max(i-diffContext, 0)
+		stop := min(end+diffContext+1, len(ops))
+
+		aCount, bCount := 0, 0
+
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aCount++
+			}
+
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(ops[start].a, aCount), hunkRange(ops[start].b, bCount))
+
+		for _, op := range ops[start:stop] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+
+		i = stop
+	}
+
+	return out.String()
+}
+
+func hunkRange(pos, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", pos)
+	}
+
+	return fmt.Sprintf("%d,%d", pos+1, count)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines computes a line edit script from the longest common
+// subsequence of a and b.
+func diffLines(a, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+
+	if len(a)*len(b) > diffMaxCells {
+		for i, l := range a {
+			ops = append(ops, diffOp{kind: '-', line: l, a: i})
+		}
+
+		for j, l := range b {
+			ops = append(ops, diffOp{kind: '+', line: l, a: len(a), b: j})
+		}
+
+		return ops
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{kind: '-', line: a[i], a: i, b: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: b[j], a: i, b: j})
+			j++
+		}
+	}
+
+	return ops
+}
@@ -0,0 +1,37 @@
+package engine
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		before, after string
+		want          string
+	}{
+		{name: "equal", before: "a\nb\n", after: "a\nb\n", want: ""},
+		{
+			name:   "new file",
+			before: "",
+			after:  "a\nb\n",
+			want:   "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:   "change in the middle",
+			before: "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			after:  "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want:   "--- old\n+++ new\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name:   "separate hunks",
+			before: "a\n1\n2\n3\n4\n5\n6\n7\n8\nb\n",
+			after:  "A\n1\n2\n3\n4\n5\n6\n7\n8\nB\n",
+			want: "--- old\n+++ new\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n" +
+				"@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-b\n+B\n",
+		},
+		{name: "binary", before: "a\x00", after: "b\x00", want: "Binary files old and new differ\n"},
+	} {
+		if got := unifiedDiff("old", "new", []byte(tc.before), []byte(tc.after)); got != tc.want {
+			t.Fatalf("%s: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -1,12 +1,19 @@
 package engine
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -22,21 +29,41 @@ type Options struct {
 	Quiet      bool
 	DryRun     bool
 	MaxWorkers int
+	FailFast   bool // cancel running tasks as soon as one fails
+	KeepGoing  bool // run every task whose dependencies succeeded
+	Strict     bool // failed commands raise Lua errors, see Config.Strict
+
+	SSHControlDir string // overrides Config.SSHControlDir
+	Inventory     string // overrides config.inventory
+
+	// EventsOut receives every event as a JSON Lines record when set,
+	// regardless of the log level.
+	EventsOut io.Writer
+	// Reports are paths the run report is written to, as JSON (.json) or
+	// JUnit XML (.xml).
+	Reports []string
+	// NoHistory turns off recording the run under .weave/.
+	NoHistory bool
+	// Force runs tasks with declared inputs and outputs even when they are
+	// up to date.
+	Force bool
 }
 
 type Engine struct {
-	opt     Options
-	bus     *events.Bus
-	L       *lua.LState
-	tasks   map[string]taskDef
-	cfg     Config
-	spinner *spinnerRenderer
+	opt       Options
+	bus       *events.Bus
+	L         *lua.LState
+	tasks     map[string]taskDef
+	cfg       Config
+	inv       inventory
+	spinner   *spinnerRenderer
+	eventsOut *events.JSONLWriter
 }
 
 type taskDef struct {
-	fn   *lua.LFunction
-	deps []string
-	help string
+	taskOptions
+
+	fn *lua.LFunction
 }
 
 func New(opts Options) *Engine {
@@ -59,6 +86,11 @@ func New(opts Options) *Engine {
 		e.spinner = newSpinnerRenderer(os.Stderr)
 	}
 
+	if opts.EventsOut != nil {
+		e.eventsOut = events.NewJSONLWriter(opts.EventsOut)
+		e.bus.Subscribe(e.eventsOut.Handle)
+	}
+
 	e.registerDSL()
 	e.subscribe()
 
@@ -77,17 +109,32 @@ func (e *Engine) subscribe() {
 		case events.TaskStart:
 			log.Debug("task start", "task", ev.Task)
 		case events.TaskEnd:
+			if cancelled, _ := ev.Fields["cancelled"].(bool); cancelled {
+				log.Warn("task cancelled", "task", ev.Task)
+				return
+			}
+
+			if allowed, _ := ev.Fields["allowed_failure"].(bool); allowed {
+				log.Warn("task failed, failure allowed", "task", ev.Task)
+				return
+			}
+
+			if upToDate, _ := ev.Fields["up_to_date"].(bool); upToDate {
+				log.Info("task up to date, skipped", "task", ev.Task)
+				return
+			}
+
 			log.Debug("task end", "task", ev.Task, "ok", ev.Fields["ok"])
 		case events.OpStart:
-			log.Debug("op start", "task", ev.Task, "op", ev.Fields["op"], "host", ev.Fields["host"])
+			log.WithPrefix(ev.Task).Debug("op start", "op", ev.Fields["op"], "op_id", ev.OpID, "host", ev.Fields["host"])
 
 			if e.spinner != nil {
 				e.spinner.Handle(ev)
 			}
 		case events.OpEnd:
-			log.Debug("op end",
-				"task", ev.Task,
+			log.WithPrefix(ev.Task).Debug("op end",
 				"op", ev.Fields["op"],
+				"op_id", ev.OpID,
 				"ok", ev.Fields["ok"],
 				"code", ev.Fields["code"],
 				"duration_ms", ev.Fields["duration_ms"],
@@ -96,8 +143,12 @@ func (e *Engine) subscribe() {
 			if e.spinner != nil {
 				e.spinner.Handle(ev)
 			}
+		case events.Progress:
+			e.printProgress(ev)
+		case events.Output:
+			e.printOutput(ev)
 		case events.Message:
-			l := log.WithPrefix("LUA")
+			l := log.WithPrefix(ev.Task)
 
 			attrs, _ := ev.Fields["attrs"].([]any)
 			if e.opt.LogFormat == log.TextFormatter {
@@ -121,6 +172,49 @@ func (e *Engine) subscribe() {
 	})
 }
 
+// printOutput echoes a streamed line of command output, prefixed with the
+// task (and host) that produced it.
+func (e *Engine) printOutput(ev events.Event) {
+	if e.opt.Quiet || log.GetLevel() > log.InfoLevel {
+		return
+	}
+
+	prefix := strField(ev.Fields, "prefix")
+	line := strField(ev.Fields, "line")
+
+	if e.opt.LogFormat == log.TextFormatter {
+		fmt.Fprintf(os.Stderr, "%s | %s\n", prefix, line)
+		return
+	}
+
+	log.WithPrefix(prefix).Info(line, "stream", ev.Fields["stream"], "host", ev.Fields["host"])
+}
+
+// printProgress shows transfer progress as a progress bar in text mode, or
+// as a log line per update in json mode.
+func (e *Engine) printProgress(ev events.Event) {
+	if e.spinner != nil {
+		e.spinner.Handle(ev)
+		return
+	}
+
+	if e.opt.Quiet || e.opt.LogFormat != log.JSONFormatter {
+		return
+	}
+
+	log.Info("progress",
+		"task", ev.Task,
+		"op", ev.Fields["op"],
+		"op_id", ev.OpID,
+		"src", ev.Fields["src"],
+		"dst", ev.Fields["dst"],
+		"bytes", ev.Fields["bytes"],
+		"percent", ev.Fields["percent"],
+		"bytes_per_sec", ev.Fields["bytes_per_sec"],
+		"eta_ms", ev.Fields["eta_ms"],
+	)
+}
+
 func attrStringAny(attrs []any, keys ...string) (string, bool) {
 	for i := 0; i+1 < len(attrs); i += 2 {
 		k, ok := attrs[i].(string)
@@ -176,19 +270,13 @@ func registerDSLWithTasks(L *lua.LState, tasks map[string]taskDef) {
 			return 1
 		}
 
-		deps, err := parseTaskDeps(opts)
-		if err != nil {
-			L.ArgError(2, err.Error())
-			return 1
-		}
-
-		help, err := parseTaskHelp(opts)
+		topts, err := parseTaskOptions(opts)
 		if err != nil {
 			L.ArgError(2, err.Error())
 			return 1
 		}
 
-		tasks[name] = taskDef{fn: fn, deps: deps, help: help}
+		tasks[name] = taskDef{taskOptions: topts, fn: fn}
 
 		return 0
 	}))
@@ -198,13 +286,27 @@ func (e *Engine) Load() error {
 	// reset tasks for idempotent laods
 	e.tasks = make(map[string]taskDef)
 	e.cfg = Config{}
+	e.inv = nil
 	registerDSLWithTasks(e.L, e.tasks)
 
 	if err := e.L.DoFile(e.opt.File); err != nil {
 		return fmt.Errorf("failure executing %s: %w", e.opt.File, err)
 	}
 
-	cfg, err := loadConfigFrom(e.L)
+	// the inventory is read once here and shared by every task attempt, so
+	// inventory scripts do not run again for each task
+	path, err := inventoryPath(e.L, filepath.Dir(e.opt.File), e.opt.Inventory)
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	if path != "" {
+		if e.inv, err = readInventory(path); err != nil {
+			return fmt.Errorf("config error: %w", err)
+		}
+	}
+
+	cfg, err := loadConfigFrom(e.L, e.inv)
 	if err != nil {
 		return fmt.Errorf("config error: %w", err)
 	}
@@ -223,6 +325,31 @@ func (e *Engine) TaskNamesWithHelp() map[string]string {
 	return out
 }
 
+// TaskInfo describes a task for display by `weave tasks`.
+type TaskInfo struct {
+	Name   string
+	Help   string
+	Params []ParamInfo
+}
+
+// Tasks returns every loaded task sorted by name.
+func (e *Engine) Tasks() []TaskInfo {
+	out := make([]TaskInfo, 0, len(e.tasks))
+
+	for _, name := range e.TaskNames() {
+		def := e.tasks[name]
+
+		info := TaskInfo{Name: name, Help: def.help}
+		for _, p := range def.params {
+			info.Params = append(info.Params, p.info())
+		}
+
+		out = append(out, info)
+	}
+
+	return out
+}
+
 func (e *Engine) TaskNames() []string {
 	out := make([]string, 0, len(e.tasks))
 	for k := range e.tasks {
@@ -234,35 +361,318 @@ func (e *Engine) TaskNames() []string {
 	return out
 }
 
-func (e *Engine) Run(name string) error {
-	graph, err := e.depsGraph(name)
+// Run executes the named tasks and everything they depend on as a single
+// graph, so shared dependencies run once and independent tasks run in
+// parallel.
+func (e *Engine) Run(ctx context.Context, names []string, args RunArgs) error {
+	if len(names) == 0 {
+		return errors.New("no tasks to run")
+	}
+
+	graph, err := e.depsGraph(names...)
 	if err != nil {
 		return err
 	}
 
-	runner := engineRunner{engine: e}
+	// check parameters for the whole graph up front so a missing or
+	// malformed value fails the run before anything has executed
+	for _, task := range slices.Sorted(maps.Keys(graph)) {
+		if _, err := resolveParams(e.tasks[string(task)].params, args.Params); err != nil {
+			return fmt.Errorf("task %q: %w", task, err)
+		}
+	}
 
-	maxWorkers := e.opt.MaxWorkers
-	if maxWorkers <= 0 {
-		maxWorkers = 1
+	if e.opt.FailFast && e.opt.KeepGoing {
+		return errors.New("fail-fast and keep-going are mutually exclusive")
 	}
 
-	return RunGraphParallel(runner, graph, maxWorkers)
+	for _, p := range e.opt.Reports {
+		if err := checkReportPath(p); err != nil {
+			return err
+		}
+	}
+
+	var mux *sshMux
+
+	if e.cfg.SSHMultiplex {
+		dir := e.cfg.SSHControlDir
+		if e.opt.SSHControlDir != "" {
+			dir = e.opt.SSHControlDir
+		}
+
+		mux, err = newSSHMux(dir)
+		if err != nil {
+			return fmt.Errorf("ssh control dir: %w", err)
+		}
+
+		defer mux.Close()
+	}
+
+	clients := newSSHClientPool()
+	defer clients.Close()
+
+	start := time.Now()
+	run := &runState{id: newRunID(start), args: args, mux: mux, clients: clients}
+	runner := engineRunner{engine: e, run: run}
+
+	report := newRunReport(run.id, start)
+	unsubscribe := e.bus.Subscribe(report.Handle)
+
+	var history *historyRecorder
+
+	if !e.opt.NoHistory {
+		if history, err = e.startHistory(run, names, start); err != nil {
+			log.Warn("unable to record the run history", "err", err)
+		}
+	}
+
+	gopts := GraphOptions{MaxWorkers: e.opt.MaxWorkers, Mode: FailStop}
+	if gopts.MaxWorkers <= 0 {
+		gopts.MaxWorkers = 1
+	}
+
+	switch {
+	case e.opt.FailFast:
+		gopts.Mode = FailFast
+	case e.opt.KeepGoing:
+		gopts.Mode = KeepGoing
+	}
+
+	result, err := RunGraphParallel(ctx, runner, graph, gopts)
+
+	unsubscribe()
+
+	if result != nil {
+		report.finish(result, time.Now())
+		e.printReport(report, result)
+
+		for _, p := range e.opt.Reports {
+			if werr := report.writeReport(p); werr != nil {
+				err = errors.Join(err, fmt.Errorf("report %s: %w", p, werr))
+			}
+		}
+	}
+
+	if e.eventsOut != nil && e.eventsOut.Err() != nil {
+		log.Warn("unable to write events", "err", e.eventsOut.Err())
+	}
+
+	if history != nil {
+		if herr := history.finish(ctx, report, err); herr != nil {
+			log.Warn("unable to record the run history", "err", herr)
+		}
+	}
+
+	return err
+}
+
+// printReport prints the end of run table in text mode, or logs the summary
+// line in json mode.
+func (e *Engine) printReport(report *runReport, result GraphResult) {
+	if e.opt.Quiet || log.GetLevel() > log.InfoLevel {
+		return
+	}
+
+	if e.opt.LogFormat != log.TextFormatter {
+		logSummary(result)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr)
+
+	if err := report.writeText(os.Stderr); err != nil {
+		log.Warn("unable to print the run report", "err", err)
+	}
+}
+
+func logSummary(result GraphResult) {
+	attrs := []any{}
+
+	for _, status := range []TaskStatus{
+		StatusSucceeded, StatusUpToDate, StatusAllowedFailure, StatusFailed, StatusSkipped, StatusCancelled,
+	} {
+		tasks := result.Tasks(status)
+		if len(tasks) == 0 {
+			continue
+		}
+
+		names := make([]string, 0, len(tasks))
+		for _, t := range tasks {
+			names = append(names, string(t))
+		}
+
+		attrs = append(attrs, string(status), strings.Join(names, ", "))
+	}
+
+	if len(result.Tasks(StatusSucceeded))+len(result.Tasks(StatusUpToDate)) == len(result) {
+		log.Info("run summary", attrs...)
+		return
+	}
+
+	log.Warn("run summary", attrs...)
 }
 
 type engineRunner struct {
 	engine *Engine
+	run    *runState
 }
 
-func (r engineRunner) Run(name TaskName) error {
+// runState is shared by every task of a single Engine.Run.
+type runState struct {
+	id      string
+	args    RunArgs
+	mux     *sshMux
+	clients *sshClientPool
+	rsync   rsyncSupport
+	ops     atomic.Uint64 // op ID counter
+}
+
+// newRunID returns an ID for a run started at t. IDs sort by start time and
+// the random suffix keeps runs started in the same millisecond apart.
+func newRunID(t time.Time) string {
+	var suffix [3]byte
+
+	_, _ = rand.Read(suffix[:])
+
+	return t.UTC().Format("20060102T150405.000Z") + "-" + hex.EncodeToString(suffix[:])
+}
+
+func (r engineRunner) Run(ctx context.Context, name TaskName) error {
 	taskName := string(name)
-	return r.engine.runTaskIsolated(taskName)
+	return r.engine.runTaskIsolated(ctx, taskName, r.run)
+}
+
+func (e *Engine) runTaskIsolated(ctx context.Context, taskName string, run *runState) error {
+	def, ok := e.tasks[taskName]
+	if !ok {
+		return fmt.Errorf("unknown task %q", taskName)
+	}
+
+	start := time.Now()
+	e.bus.Emit(events.Event{
+		Type:  events.TaskStart,
+		Time:  time.Now(),
+		Task:  taskName,
+		RunID: run.id,
+		Fields: map[string]any{
+			"task": taskName,
+		},
+	})
+
+	var (
+		fp       fingerprint
+		tracked  = def.incremental()
+		upToDate bool
+	)
+
+	if tracked {
+		var err error
+		if fp, upToDate, err = e.checkFingerprint(taskName, def, run); err != nil {
+			log.Warn("unable to fingerprint the task, running it", "task", taskName, "err", err)
+			tracked = false
+		}
+	}
+
+	if upToDate {
+		e.bus.Emit(events.Event{
+			Type:  events.TaskEnd,
+			Time:  time.Now(),
+			Task:  taskName,
+			RunID: run.id,
+			Fields: map[string]any{
+				"task":            taskName,
+				"ok":              true,
+				"up_to_date":      true,
+				"cancelled":       false,
+				"timed_out":       false,
+				"allowed_failure": false,
+				"attempts":        0,
+				"duration_ms":     time.Since(start).Milliseconds(),
+			},
+		})
+
+		return ErrUpToDate
+	}
+
+	var (
+		err      error
+		attempts int
+		timedOut bool
+	)
+
+	for {
+		attempts++
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if def.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, def.timeout)
+		}
+
+		err = e.runTaskAttempt(attemptCtx, taskName, run)
+		timedOut = err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+
+		cancel()
+
+		if timedOut {
+			err = fmt.Errorf("timed out after %s: %w", def.timeout, err)
+		}
+
+		if err == nil || ctx.Err() != nil || attempts > def.retries {
+			break
+		}
+
+		log.Warn("task failed, retrying", "task", taskName, "attempt", attempts, "err", err)
+	}
+
+	// only an attempt cut short by the run being cancelled counts as
+	// cancelled, not one that finished or failed by itself just before
+	cancelled := err != nil && ctx.Err() != nil && isContextErr(err)
+
+	allowed := err != nil && !cancelled && def.allowFailure
+
+	if err == nil && tracked && !e.opt.DryRun {
+		if ferr := e.recordFingerprint(taskName, def, fp); ferr != nil {
+			log.Warn("unable to record the task fingerprint", "task", taskName, "err", ferr)
+		}
+	}
+
+	fields := map[string]any{
+		"task":            taskName,
+		"ok":              err == nil,
+		"up_to_date":      false,
+		"cancelled":       cancelled,
+		"timed_out":       timedOut,
+		"allowed_failure": allowed,
+		"attempts":        attempts,
+		"duration_ms":     time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+
+	e.bus.Emit(events.Event{
+		Type:   events.TaskEnd,
+		Time:   time.Now(),
+		Task:   taskName,
+		RunID:  run.id,
+		Fields: fields,
+	})
+
+	if allowed {
+		return fmt.Errorf("%w: %w", ErrAllowedFailure, err)
+	}
+
+	return err
 }
 
-func (e *Engine) runTaskIsolated(taskName string) error {
+// runTaskAttempt runs a single attempt of taskName in a fresh Lua state so
+// retries and parallel tasks never share interpreter state.
+func (e *Engine) runTaskAttempt(ctx context.Context, taskName string, run *runState) error {
 	L := lua.NewState()
 	defer L.Close()
 
+	L.SetContext(ctx)
+
 	tasks := make(map[string]taskDef)
 	registerDSLWithTasks(L, tasks)
 
@@ -270,7 +680,7 @@ func (e *Engine) runTaskIsolated(taskName string) error {
 		return fmt.Errorf("failure executing %s: %w", e.opt.File, err)
 	}
 
-	cfg, err := loadConfigFrom(L)
+	cfg, err := loadConfigFrom(L, e.inv)
 	if err != nil {
 		return fmt.Errorf("config error: %w", err)
 	}
@@ -280,43 +690,46 @@ func (e *Engine) runTaskIsolated(taskName string) error {
 		return fmt.Errorf("unknown task %q", taskName)
 	}
 
-	ctx := NewCtx(L, e.bus)
-	ctx.cfg = cfg
-	ctx.dryRun = e.opt.DryRun
+	params, err := resolveParams(def.params, run.args.Params)
+	if err != nil {
+		return err
+	}
 
-	start := time.Now()
-	e.bus.Emit(events.Event{
-		Type: events.TaskStart,
-		Time: time.Now(),
-		Task: taskName,
-		Fields: map[string]any{
-			"task": taskName,
-		},
-	})
+	tctx := NewCtx(ctx, L, e.bus)
+	tctx.setInvocation(params, run.args.Extra)
+	tctx.mux = run.mux
+	tctx.clients = run.clients
+	tctx.rsync = &run.rsync
+	tctx.cfg = cfg
+	tctx.dryRun = e.opt.DryRun
+	tctx.strict = e.opt.Strict || cfg.Strict
+	tctx.task = taskName
+	tctx.runID = run.id
+	tctx.ops = &run.ops
+	tctx.env = mergeEnv(cfg.Env, def.env)
 
 	err = L.CallByParam(lua.P{
 		Fn:      def.fn,
 		NRet:    0,
 		Protect: true,
-	}, ctx.ud)
+	}, tctx.ud)
 
-	e.bus.Emit(events.Event{
-		Type: events.TaskEnd,
-		Time: time.Now(),
-		Task: taskName,
-		Fields: map[string]any{
-			"task":        taskName,
-			"ok":          err == nil,
-			"duration_ms": time.Since(start).Milliseconds(),
-		},
-	})
+	// a cancelled context surfaces from Lua as a plain string error, so
+	// report the context error instead to keep errors.Is usable by callers.
+	// An attempt that finished before the cancellation still succeeded.
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
 
 	return err
 }
 
-func (e *Engine) depsGraph(root string) (map[TaskName][]TaskName, error) {
-	if _, ok := e.tasks[root]; !ok {
-		return nil, fmt.Errorf("unknown task %q", root)
+// depsGraph merges the dependency graphs of every root into one DAG.
+func (e *Engine) depsGraph(roots ...string) (map[TaskName][]TaskName, error) {
+	for _, root := range roots {
+		if _, ok := e.tasks[root]; !ok {
+			return nil, fmt.Errorf("unknown task %q", root)
+		}
 	}
 
 	graph := map[TaskName][]TaskName{}
@@ -353,57 +766,11 @@ func (e *Engine) depsGraph(root string) (map[TaskName][]TaskName, error) {
 		return nil
 	}
 
-	if err := visit(root); err != nil {
-		return nil, err
-	}
-
-	return graph, nil
-}
-
-func parseTaskDeps(opts *lua.LTable) ([]string, error) {
-	if opts == nil {
-		return nil, nil
-	}
-
-	lv := opts.RawGetString("depends")
-	if lv == lua.LNil {
-		return nil, nil
-	}
-
-	tbl, ok := lv.(*lua.LTable)
-	if !ok {
-		return nil, errors.New("depends must be a table of strings")
-	}
-
-	deps := []string{}
-
-	tbl.ForEach(func(_, v lua.LValue) {
-		if s, ok := v.(lua.LString); ok {
-			deps = append(deps, string(s))
+	for _, root := range roots {
+		if err := visit(root); err != nil {
+			return nil, err
 		}
-	})
-
-	if len(deps) != tbl.Len() {
-		return nil, errors.New("depends must be a table of strings")
-	}
-
-	return deps, nil
-}
-
-func parseTaskHelp(opts *lua.LTable) (string, error) {
-	if opts == nil {
-		return "", nil
 	}
 
-	lv := opts.RawGetString("help")
-	if lv == lua.LNil {
-		return "", nil
-	}
-
-	s, ok := lv.(lua.LString)
-	if !ok {
-		return "", errors.New("help must be a string")
-	}
-
-	return string(s), nil
+	return graph, nil
 }
@@ -1,11 +1,21 @@
 package engine
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/charmbracelet/log"
+
+	"github.com/pix-xip/weave/internal/events"
 )
 
 func TestEngineRunWithDeps(t *testing.T) {
@@ -36,7 +46,845 @@ end)
 	if err := e.Load(); err != nil {
 		t.Fatalf("Load: %v", err)
 	}
-	if err := e.Run("release"); err != nil {
+	if err := e.Run(context.Background(), []string{"release"}, RunArgs{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestEngineRunCancelKillsCommand(t *testing.T) {
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("slow", function(ctx)
+  ctx:run("sleep 30")
+end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{
+		File:      weavefile,
+		LogFormat: log.TextFormatter,
+		Quiet:     true,
+	})
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := e.Run(ctx, []string{"slow"}, RunArgs{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("run was not interrupted promptly: %v", time.Since(start))
+	}
+}
+
+func runWeavefile(t *testing.T, src string, opts Options, task string) error {
+	t.Helper()
+	return runWeavefileArgs(t, src, opts, task, RunArgs{})
+}
+
+func TestCtxRunRetriesAndTimeout(t *testing.T) {
+	err := runWeavefile(t, `
+task("retry", function(ctx)
+  local r = ctx:run("exit 3", { retries = 2 })
+  assert(not r.ok, "expected failure")
+  assert(r.code == 3, "expected code 3, got " .. r.code)
+  assert(r.attempts == 3, "expected 3 attempts, got " .. r.attempts)
+
+  r = ctx:run("sleep 5", { timeout = "100ms" })
+  assert(r.timed_out, "expected timeout")
+  assert(r.code == 124, "expected code 124, got " .. r.code)
+  assert(r.attempts == 1, "expected 1 attempt, got " .. r.attempts)
+
+  r = ctx:run("echo ok", { timeout = 5, retries = 1, backoff = "10ms" })
+  assert(r.ok and r.attempts == 1, "expected first attempt to pass")
+end)
+`, Options{}, "retry")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestCtxRunRejectsUnknownOption(t *testing.T) {
+	err := runWeavefile(t, `
+task("bad", function(ctx)
+  ctx:run("true", { tiemout = "1s" })
+end)
+`, Options{}, "bad")
+	if err == nil || !strings.Contains(err.Error(), `unknown option "tiemout"`) {
+		t.Fatalf("expected unknown option error, got %v", err)
+	}
+}
+
+func TestTaskRetriesTimeoutAndAllowFailure(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "attempts")
+	err := runWeavefile(t, `
+task("flaky", { retries = 2 }, function(ctx)
+  local f = io.open("`+counter+`", "a")
+  f:write("x")
+  f:close()
+  local n = #io.open("`+counter+`"):read("*a")
+  if n < 2 then error("flaky failure") end
+end)
+
+task("hang", { timeout = "100ms", allow_failure = true }, function(ctx)
+  ctx:run("sleep 5")
+end)
+
+task("all", { depends = { "flaky", "hang" } }, function(ctx)
+  ctx:log("info", "done")
+end)
+`, Options{MaxWorkers: 2}, "all")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	data, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatalf("read counter: %v", err)
+	}
+	if string(data) != "xx" {
+		t.Fatalf("expected two attempts, got %q", data)
+	}
+}
+
+func TestTaskRejectsUnknownOption(t *testing.T) {
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("bad", { depnds = { "x" } }, function(ctx) end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true})
+	defer e.Close()
+
+	err := e.Load()
+	if err == nil || !strings.Contains(err.Error(), `unknown task option "depnds"`) {
+		t.Fatalf("expected unknown task option error, got %v", err)
+	}
+}
+
+func TestCtxRunStreamsOutputEvents(t *testing.T) {
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("stream", function(ctx)
+  local r = ctx:run("echo one; echo two >&2; printf three")
+  assert(r.out == "one\nthree", "unexpected capture: " .. r.out)
+  assert(r.err == "two\n", "unexpected capture: " .. r.err)
+  ctx:run("echo hidden", { stream = false })
+end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true})
+	defer e.Close()
+
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+
+	e.bus.Subscribe(func(ev events.Event) {
+		if ev.Type != events.Output {
+			return
+		}
+		mu.Lock()
+		lines = append(lines, strField(ev.Fields, "prefix")+" "+strField(ev.Fields, "stream")+" "+strField(ev.Fields, "line"))
+		mu.Unlock()
+	})
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := e.Run(context.Background(), []string{"stream"}, RunArgs{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	sort.Strings(lines)
+	want := []string{"stream stderr two", "stream stdout one", "stream stdout three"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Fatalf("unexpected output events: %v", lines)
+	}
+}
+
+func TestStrictModeRaisesOnFailure(t *testing.T) {
+	src := `
+task("strict", function(ctx)
+  local r = ctx:run("echo nope >&2; exit 4", { check = false })
+  assert(not r.ok and r.code == 4, "expected unchecked failure")
+  ctx:run("echo boom >&2; exit 3")
+  error("unreachable")
+end)
+`
+
+	err := runWeavefile(t, src, Options{Strict: true}, "strict")
+	if err == nil {
+		t.Fatalf("expected strict failure")
+	}
+	for _, want := range []string{"exit 3", "echo boom", "boom"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error, got %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("task kept running after a failed command: %v", err)
+	}
+
+	err = runWeavefile(t, "config = { strict = true }\n"+src, Options{}, "strict")
+	if err == nil || !strings.Contains(err.Error(), "exit 3") {
+		t.Fatalf("expected config strict failure, got %v", err)
+	}
+
+	err = runWeavefile(t, `
+task("lenient", function(ctx)
+  local r = ctx:run("exit 3")
+  assert(not r.ok, "expected failure result")
+end)
+`, Options{}, "lenient")
+	if err != nil {
+		t.Fatalf("non-strict run should not fail: %v", err)
+	}
+}
+
+func TestRunParamsAndArgs(t *testing.T) {
+	src := `
+task("prepare", { params = { env = { required = true } } }, function(ctx)
+  assert(ctx.params.env == "prod", "unexpected env")
+end)
+
+task("deploy", {
+  depends = { "prepare" },
+  params = {
+    env = { required = true },
+    version = { default = "latest" },
+    replicas = { type = "number", default = 2 },
+    canary = { type = "bool", default = false },
+  },
+}, function(ctx)
+  assert(ctx.params.env == "prod", "unexpected env")
+  assert(ctx.params.version == "latest", "unexpected version")
+  assert(ctx.params.replicas == 3, "unexpected replicas")
+  assert(ctx.params.canary == true, "unexpected canary")
+  assert(ctx.params.extra == "x", "undeclared params should pass through")
+  assert(#ctx.args == 2 and ctx.args[1] == "a" and ctx.args[2] == "b", "unexpected args")
+end)
+`
+
+	err := runWeavefileArgs(t, src, Options{}, "deploy", RunArgs{
+		Params: map[string]string{"env": "prod", "replicas": "3", "canary": "true", "extra": "x"},
+		Extra:  []string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	err = runWeavefileArgs(t, src, Options{}, "deploy", RunArgs{})
+	if err == nil || !strings.Contains(err.Error(), `missing required parameter "env"`) {
+		t.Fatalf("expected missing parameter error, got %v", err)
+	}
+
+	err = runWeavefileArgs(t, src, Options{}, "deploy", RunArgs{Params: map[string]string{"env": "prod", "replicas": "many"}})
+	if err == nil || !strings.Contains(err.Error(), `"replicas" must be a number`) {
+		t.Fatalf("expected type error, got %v", err)
+	}
+}
+
+func runWeavefileArgs(t *testing.T, src string, opts Options, task string, args RunArgs) error {
+	t.Helper()
+
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(src), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	opts.File = weavefile
+	opts.LogFormat = log.TextFormatter
+	opts.Quiet = true
+
+	e := New(opts)
+	defer e.Close()
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	return e.Run(context.Background(), []string{task}, args)
+}
+
+func TestRunMultipleRootsSharesDependencies(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "order")
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+local function record(name)
+  local f = io.open("`+logFile+`", "a")
+  f:write(name .. "\n")
+  f:close()
+end
+
+task("sync", function(ctx) record("sync") end)
+task("lint", { depends = { "sync" } }, function(ctx) record("lint") end)
+task("test", { depends = { "sync" } }, function(ctx) record("test") end)
+task("build", { depends = { "test" } }, function(ctx) record("build") end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true, MaxWorkers: 1})
+	defer e.Close()
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := e.Run(context.Background(), []string{"build", "lint", "test"}, RunArgs{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	got := strings.Fields(string(data))
+	want := []string{"sync", "lint", "test", "build"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("order mismatch: got %v want %v", got, want)
+	}
+
+	if err := e.Run(context.Background(), []string{"build", "missing"}, RunArgs{}); err == nil {
+		t.Fatalf("expected unknown task error")
+	}
+}
+
+func TestCtxRunEnvAndCwd(t *testing.T) {
+	dir := t.TempDir()
+	err := runWeavefile(t, `
+config = { env = { LAYER = "config", FROM_CONFIG = "yes" } }
+
+task("env", { env = { LAYER = "task", FROM_TASK = 1 } }, function(ctx)
+  local r = ctx:run("printf '%s %s %s' \"$LAYER\" \"$FROM_CONFIG\" \"$FROM_TASK\"")
+  assert(r.out == "task yes 1", "unexpected task env: " .. r.out)
+
+  r = ctx:run("printf '%s' \"$LAYER\"", { env = { LAYER = "call" } })
+  assert(r.out == "call", "unexpected call env: " .. r.out)
+
+  r = ctx:run("pwd", { cwd = "`+dir+`" })
+  assert(r.out == "`+dir+`\n", "unexpected cwd: " .. r.out)
+end)
+`, Options{}, "env")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+// fakeSSH puts an ssh stand-in on PATH that records its arguments and runs
+// the remote command locally, with the target host in $FAKE_SSH_HOST.
+func fakeSSH(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "ssh.log")
+	script := `#!/bin/sh
+echo "$@" >> "` + logFile + `"
+for last; do host=$prev2; prev2=$prev; prev=$last; done
+case " $* " in
+  *" -O exit "*) exit 0 ;;
+esac
+export FAKE_SSH_HOST="$host"
+exec sh -c "$last"
+`
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0o700); err != nil {
+		t.Fatalf("write fake ssh: %v", err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return logFile
+}
+
+func TestSSHMultiplexing(t *testing.T) {
+	logFile := fakeSSH(t)
+	// t.TempDir paths leave too little room for the socket names
+	controlDir, err := os.MkdirTemp("/tmp", "wv")
+	if err != nil {
+		t.Fatalf("control dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(controlDir) })
+
+	err = runWeavefile(t, `
+config = {
+  hosts = {
+    box = { addr = "box.example.com", user = "ci", port = 2222 },
+    solo = { addr = "solo.example.com", multiplex = false },
+  },
+}
+
+task("remote", function(ctx)
+  local r = ctx:run("box", "echo one")
+  assert(r.ok and r.out == "one\n", "unexpected output: " .. r.out .. r.err)
+  ctx:run("box", "echo two")
+  ctx:run("solo", "echo three")
+end)
+`, Options{SSHControlDir: controlDir}, "remote")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("read ssh log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 3 commands and 1 teardown, got %d:\n%s", len(lines), data)
+	}
+
+	controlPath := "ControlPath=" + filepath.Join(controlDir, "%C")
+	for _, line := range lines[:2] {
+		if !strings.HasPrefix(line, "-p 2222 -o ControlMaster=auto -o "+controlPath) {
+			t.Fatalf("expected multiplexed ssh call, got %q", line)
+		}
+	}
+	if strings.Contains(lines[2], "ControlMaster") {
+		t.Fatalf("expected solo host to skip multiplexing, got %q", lines[2])
+	}
+	if !strings.Contains(lines[3], controlPath) || !strings.HasSuffix(lines[3], "-O exit ci@box.example.com") {
+		t.Fatalf("expected master teardown, got %q", lines[3])
+	}
+}
+
+func TestCtxRunHostGroupFanOut(t *testing.T) {
+	fakeSSH(t)
+
+	err := runWeavefile(t, `
+config = {
+  ssh_multiplex = false,
+  hosts = {
+    web1 = { addr = "web1.example.com" },
+    web2 = { addr = "web2.example.com" },
+    web3 = { addr = "web3.example.com" },
+  },
+  groups = { web = { "web1", "web2", "web3" } },
+}
+
+local cmd = "case $FAKE_SSH_HOST in web2.*) echo broken >&2; exit 7;; esac; echo up"
+
+task("fanout", function(ctx)
+  local r = ctx:run("@web", cmd, { parallel = 2 })
+  assert(not r.ok and r.failed == 1 and r.skipped == 0, "unexpected summary ")
+  assert(r.hosts.web1.ok and r.hosts.web1.out == "up\n", "web1 should succeed")
+  assert(not r.hosts.web2.ok and r.hosts.web2.code == 7, "web2 should fail")
+  assert(r.hosts.web3.ok, "web3 should succeed")
+
+  r = ctx:run("@web", cmd, { parallel = 1, max_failures = 1 })
+  assert(r.failed == 1 and r.skipped == 1, "expected web3 to be skipped")
+  assert(r.hosts.web3.skipped and not r.hosts.web3.ok, "web3 should be skipped")
+
+  r = ctx:run("@web", cmd, { batch = 1, max_failures = 1 })
+  assert(r.hosts.web1.ok and r.hosts.web3.skipped, "rolling batches should stop after web2")
+
+  local ok, msg = pcall(function() ctx:run("@web", cmd, { check = true }) end)
+  assert(not ok and string.find(msg, "web2: exit 7", 1, true), "expected strict group error: " .. tostring(msg))
+end)
+`, Options{}, "fanout")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestInventoryRelativeToWeavefile(t *testing.T) {
+	fakeSSH(t)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hosts.json"),
+		[]byte(`{"hosts": {"box": {"addr": "box.example.com"}}, "groups": {"all": ["box"]}}`), 0o600); err != nil {
+		t.Fatalf("write inventory: %v", err)
+	}
+
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+config = { inventory = "hosts.json", ssh_multiplex = false }
+
+task("remote", function(ctx)
+  local r = ctx:run("@all", "echo hi")
+  assert(r.ok and r.hosts.box.out == "hi\n", "unexpected result")
+end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	t.Chdir(t.TempDir())
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true})
+	defer e.Close()
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if err := e.Run(context.Background(), []string{"remote"}, RunArgs{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestHostVars(t *testing.T) {
+	fakeSSH(t)
+
+	err := runWeavefile(t, `
+config = {
+  ssh_multiplex = false,
+  hosts = {
+    staging = { addr = "staging.example.com", vars = { deploy_dir = "/srv/staging" } },
+    prod = { addr = "prod.example.com", vars = { deploy_dir = "/srv/prod", replicas = 3 } },
+  },
+  groups = {
+    all = { hosts = { "staging", "prod" }, vars = { app = "shop", replicas = 1 } },
+  },
+}
+
+task("vars", function(ctx)
+  local prod = ctx:host("prod")
+  assert(prod.addr == "prod.example.com", "unexpected addr")
+  assert(prod.vars.deploy_dir == "/srv/prod" and prod.vars.app == "shop", "unexpected prod vars")
+  assert(prod.vars.replicas == 3, "host vars should win over group vars")
+  assert(ctx:host("staging").vars.replicas == 1, "staging should inherit group vars")
+
+  local r = ctx:run("prod", "echo {{ app }} {{ deploy_dir }}")
+  assert(r.out == "shop /srv/prod\n", "unexpected output: " .. r.out)
+
+  r = ctx:run("@all", "echo {{ host }} {{ deploy_dir }} {{ replicas }}")
+  assert(r.hosts.staging.out == "staging /srv/staging 1\n", "unexpected staging output: " .. r.hosts.staging.out)
+  assert(r.hosts.prod.out == "prod /srv/prod 3\n", "unexpected prod output: " .. r.hosts.prod.out)
+
+  -- names that are not vars are left for the remote side, such as Go templates
+  r = ctx:run("prod", "echo '{{ nope }} {{range .Mounts}}{{.Source}}{{end}}'")
+  assert(r.out == "{{ nope }} {{range .Mounts}}{{.Source}}{{end}}\n", "unexpected unknown placeholder output: " .. r.out)
+
+  local ok, msg = pcall(function() ctx:run("prod", "echo {{ deploy_dir.x }} {{ missing }}", { check = true }) end)
+  assert(ok, "unknown nested names should not raise: " .. tostring(msg))
+
+  -- literal placeholders reach the remote shell, escaped or with interpolation off
+  r = ctx:run("prod", [[echo '\{{ x }} {{ deploy_dir }}']])
+  assert(r.out == "{{ x }} /srv/prod\n", "unexpected escaped output: " .. r.out)
+
+  r = ctx:run("prod", "echo '{{ x }}'", { interpolate = false })
+  assert(r.out == "{{ x }}\n", "unexpected uninterpolated output: " .. r.out)
+
+  r = ctx:run("@all", "echo '{{ x }}'", { interpolate = false })
+  assert(r.hosts.prod.out == "{{ x }}\n", "unexpected uninterpolated group output: " .. r.hosts.prod.out)
+
+  -- local commands are left alone
+  r = ctx:run("echo '{{ deploy_dir }}'")
+  assert(r.out == "{{ deploy_dir }}\n", "unexpected local output: " .. r.out)
+end)
+`, Options{}, "vars")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestSyncOptionsAndPreview(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "rsync.log")
+	script := `#!/bin/sh
+[ "$1" = --version ] && echo "rsync  version 3.2.7  protocol version 31" && exit
+echo "$@" >> "` + logFile + `"
+case " $* " in
+  *" --dry-run "*) printf '>f+++++++++ app.js\n*deleting   stale.js\n' ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "rsync"), []byte(script), 0o700); err != nil {
+		t.Fatalf("write fake rsync: %v", err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dst := filepath.Join(t.TempDir(), "preview") + "/"
+	logs := filepath.Join(t.TempDir(), "logs") + "/"
+
+	err := runWeavefile(t, `
+task("deploy", function(ctx)
+  local r = ctx:sync("./dist/", "`+dst+`", { dry_run = true, exclude = { "*.map" }, bwlimit = 500 })
+  assert(r.ok, "preview failed")
+  assert(#r.changes == 2, "expected 2 changes, got " .. #r.changes)
+  assert(r.changes[1].path == "app.js" and r.changes[1].action == "create", "unexpected first change")
+  assert(r.changes[2].path == "stale.js" and r.changes[2].action == "delete", "unexpected second change")
+
+  r = ctx:fetch("host:/var/log/", "`+logs+`", { checksum = true })
+  assert(r.ok and r.changes == nil, "unexpected fetch result")
+
+  local ok = pcall(function() ctx:sync("a", "b", { bwlimit = "fast" }) end)
+  assert(not ok, "expected bwlimit error")
+end)
+`, Options{}, "deploy")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("preview should not create %s: %v", dst, err)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("read rsync log: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 rsync calls, got %q", lines)
+	}
+
+	if want := "-az --delete --bwlimit=500 --exclude=*.map --dry-run --itemize-changes ./dist/ " + dst; lines[0] != want {
+		t.Fatalf("unexpected sync args:\ngot  %s\nwant %s", lines[0], want)
+	}
+
+	if want := "-az --checksum --info=progress2 host:/var/log/ " + logs; lines[1] != want {
+		t.Fatalf("unexpected fetch args:\ngot  %s\nwant %s", lines[1], want)
+	}
+}
+
+func TestSyncProgressEvents(t *testing.T) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+[ "$1" = --version ] && echo "rsync  version v3.4.1  protocol version 32" && exit
+printf '     1,024  50%%    1.00MB/s    0:00:01\r     2,048 100%%    2.00MB/s    0:00:00 (xfr#1, to-chk=0/1)\n'
+printf 'sent 2,150 bytes\n'
+`
+	if err := os.WriteFile(filepath.Join(dir, "rsync"), []byte(script), 0o700); err != nil {
+		t.Fatalf("write fake rsync: %v", err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dst := filepath.Join(t.TempDir(), "out") + "/"
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("push", function(ctx)
+  local r = ctx:sync("./dist/", "`+dst+`")
+  assert(r.ok and r.out == "sent 2,150 bytes\n", "unexpected output: " .. r.out)
+  ctx:sync("./dist/", "`+dst+`", { progress = false })
+end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true})
+	defer e.Close()
+
+	var (
+		mu      sync.Mutex
+		percent []int
+	)
+
+	e.bus.Subscribe(func(ev events.Event) {
+		if ev.Type != events.Progress {
+			return
+		}
+
+		mu.Lock()
+		p, _ := ev.Fields["percent"].(int)
+		percent = append(percent, p)
+		mu.Unlock()
+
+		if ev.Task != "push" || strField(ev.Fields, "op") != "sync" || strField(ev.Fields, "dst") != dst {
+			t.Errorf("unexpected progress event %+v", ev)
+		}
+	})
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if err := e.Run(context.Background(), []string{"push"}, RunArgs{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// the second sync has progress turned off, so its lines are plain output
+	if len(percent) != 2 || percent[0] != 50 || percent[1] != 100 {
+		t.Fatalf("unexpected progress events %v", percent)
+	}
+}
+
+func TestSyncSkipsProgressOnOldRsync(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "rsync.log")
+	script := `#!/bin/sh
+echo "$@" >> "` + logFile + `"
+[ "$1" = --version ] && printf 'openrsync: protocol version 29\nrsync version 2.6.9 compatible\n'
+exit 0
+`
+	if err := os.WriteFile(filepath.Join(dir, "rsync"), []byte(script), 0o700); err != nil {
+		t.Fatalf("write fake rsync: %v", err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dst := filepath.Join(t.TempDir(), "out") + "/"
+
+	err := runWeavefile(t, `
+task("push", function(ctx)
+  assert(ctx:sync("./dist/", "`+dst+`").ok, "first sync failed")
+  assert(ctx:fetch("host:/var/log/", "`+dst+`").ok, "fetch failed")
+end)
+`, Options{}, "push")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("read rsync log: %v", err)
+	}
+
+	// the version is asked for once per run, and progress is left off
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "--version" {
+		t.Fatalf("unexpected rsync calls %q", lines)
+	}
+
+	for _, line := range lines[1:] {
+		if strings.Contains(line, "--info=progress2") {
+			t.Fatalf("expected no progress flag for an old rsync: %s", line)
+		}
+	}
+}
+
+func TestEventsCarryTaskRunAndOpIDs(t *testing.T) {
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("a", function(ctx)
+  ctx:run("echo from-a")
+  ctx:log("info", "hello from a")
+end)
+
+task("b", function(ctx)
+  ctx:run("echo from-b")
+  ctx:write_file("`+dir+`/b.txt", "b\n")
+end)
+
+task("all", { depends = { "a", "b" } }, function(ctx) end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true, MaxWorkers: 2})
+	defer e.Close()
+
+	var (
+		mu  sync.Mutex
+		evs []events.Event
+	)
+
+	e.bus.Subscribe(func(ev events.Event) {
+		mu.Lock()
+		evs = append(evs, ev)
+		mu.Unlock()
+	})
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := e.Run(context.Background(), []string{"all"}, RunArgs{}); err != nil {
 		t.Fatalf("Run: %v", err)
 	}
+
+	runID := evs[0].RunID
+	if runID == "" {
+		t.Fatalf("expected a run ID on %+v", evs[0])
+	}
+
+	starts := map[string]string{} // op ID -> task
+	ends := map[string]string{}
+
+	for _, ev := range evs {
+		if ev.RunID != runID {
+			t.Fatalf("event from another run: %+v", ev)
+		}
+
+		switch ev.Type {
+		case events.OpStart:
+			if _, dup := starts[ev.OpID]; dup || ev.OpID == "" {
+				t.Fatalf("expected a unique op ID: %+v", ev)
+			}
+
+			starts[ev.OpID] = ev.Task
+		case events.OpEnd:
+			ends[ev.OpID] = ev.Task
+		case events.Output:
+			if want := "from-" + ev.Task; strField(ev.Fields, "line") != want || starts[ev.OpID] != ev.Task {
+				t.Fatalf("output attributed to the wrong task or op: %+v", ev)
+			}
+		case events.Message:
+			if ev.Task != "a" {
+				t.Fatalf("message attributed to %q", ev.Task)
+			}
+		}
+	}
+
+	if len(starts) != 3 || len(ends) != 3 {
+		t.Fatalf("expected 3 ops, got starts %v ends %v", starts, ends)
+	}
+
+	for id, task := range starts {
+		if ends[id] != task || (task != "a" && task != "b") {
+			t.Fatalf("op %s started by %q ended by %q", id, task, ends[id])
+		}
+	}
+}
+
+func TestEventsOutWritesJSONLines(t *testing.T) {
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("hello", function(ctx)
+  ctx:run("echo hi")
+end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	var out bytes.Buffer
+
+	// events are written even though logging is turned off
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true, EventsOut: &out})
+	defer e.Close()
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := e.Run(context.Background(), []string{"hello"}, RunArgs{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	var types []string
+
+	for line := range strings.Lines(out.String()) {
+		var rec events.Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+
+		if rec.Version != events.SchemaVersion || rec.Task != "hello" || rec.RunID == "" {
+			t.Fatalf("unexpected record %+v", rec)
+		}
+
+		types = append(types, string(rec.Type))
+	}
+
+	want := "task_start op_start output op_end task_end"
+	if strings.Join(types, " ") != want {
+		t.Fatalf("unexpected event types %v", types)
+	}
 }
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+// exitTimedOut is reported as the exit code of an attempt killed by its
+// timeout, matching timeout(1).
+const exitTimedOut = 124
+
+// attemptFunc performs a single attempt of an operation, writing process
+// output to stdout and stderr.
+type attemptFunc func(ctx context.Context, stdout, stderr io.Writer) error
+
+type cmdResult struct {
+	stdout   string
+	stderr   string
+	code     int
+	err      error
+	attempts int
+	timedOut bool
+}
+
+func (r cmdResult) ok() bool {
+	return r.err == nil
+}
+
+func execAttempt(name string, args ...string) attemptFunc {
+	return execAttemptIn("", nil, name, args...)
+}
+
+// execAttemptIn runs the command from dir with env added on top of the
+// inherited environment.
+func execAttemptIn(dir string, env map[string]string, name string, args ...string) attemptFunc {
+	return func(ctx context.Context, stdout, stderr io.Writer) error {
+		cmd := command(ctx, name, args...)
+
+		cmd.Dir = dir
+		if len(env) > 0 {
+			cmd.Env = os.Environ()
+			for _, k := range slices.Sorted(maps.Keys(env)) {
+				cmd.Env = append(cmd.Env, k+"="+env[k])
+			}
+		}
+
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		return cmd.Run()
+	}
+}
+
+// command builds a process that runs in its own process group, so it is
+// killed along with its children when ctx is done.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+
+	return cmd
+}
+
+// lineFunc receives each line of output as it is produced, stream is either
+// "stdout" or "stderr".
+type lineFunc func(stream, line string)
+
+// runWithRetry runs attempt until it succeeds, the retries in opts are used
+// up or ctx is cancelled. Only the output of the final attempt is kept, but
+// when onLine is set every line of every attempt is passed to it as it is
+// written.
+func runWithRetry(ctx context.Context, opts opOptions, attempt attemptFunc, onLine lineFunc) cmdResult {
+	res := cmdResult{}
+
+	for {
+		res.attempts++
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+		}
+
+		var stdout, stderr bytes.Buffer
+
+		var outw, errw io.Writer = &stdout, &stderr
+
+		var flush func()
+
+		if onLine != nil {
+			outLines := newLineWriter(func(line string) { onLine("stdout", line) })
+			errLines := newLineWriter(func(line string) { onLine("stderr", line) })
+			outw = io.MultiWriter(&stdout, outLines)
+			errw = io.MultiWriter(&stderr, errLines)
+			flush = func() {
+				outLines.Flush()
+				errLines.Flush()
+			}
+		}
+
+		err := attempt(attemptCtx, outw, errw)
+		if flush != nil {
+			flush()
+		}
+
+		timedOut := err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+
+		cancel()
+
+		res.stdout = stdout.String()
+		res.stderr = stderr.String()
+		res.err = err
+		res.timedOut = timedOut
+		res.code = exitCode(err)
+
+		if timedOut {
+			res.code = exitTimedOut
+		}
+
+		if err == nil || ctx.Err() != nil || res.attempts > opts.retries {
+			return res
+		}
+
+		if opts.backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return res
+			case <-time.After(opts.backoff):
+			}
+		}
+	}
+}
+
+// exitCode makes a best-effort guess at the exit code behind err.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var ec exitCoder
+	if errors.As(err, &ec) && ec.ExitCode() >= 0 {
+		return ec.ExitCode()
+	}
+
+	return 1
+}
@@ -0,0 +1,583 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/pix-xip/weave/internal/events"
+)
+
+// Template engines accepted by ctx:template's engine option.
+const (
+	templateGo          = "go"          // text/template, {{ .name }}
+	templateInterpolate = "interpolate" // the {{ name }} placeholders of ctx:run
+)
+
+// fileTarget is one side of a file op: a local path, or a path on a host.
+type fileTarget struct {
+	alias string      // host as written in the spec, empty for local paths
+	host  *HostConfig // nil for local paths
+	path  string
+}
+
+func (t fileTarget) String() string {
+	if t.host == nil {
+		return t.path
+	}
+
+	return t.alias + ":" + t.path
+}
+
+// resolveFileTarget splits a host:path spec. Hosts that are not configured
+// are reached directly, like ctx:sync does.
+func (c *Ctx) resolveFileTarget(spec string) fileTarget {
+	alias, p, ok := splitHostPath(spec)
+	if !ok {
+		return fileTarget{path: spec}
+	}
+
+	host, ok := c.cfg.Hosts[alias]
+	if !ok {
+		host = HostConfig{Addr: alias, Multiplex: true}
+	}
+
+	return fileTarget{alias: alias, host: &host, path: p}
+}
+
+// readTarget returns the contents of t and whether it exists.
+func (c *Ctx) readTarget(ctx context.Context, t fileTarget) ([]byte, bool, error) {
+	if t.host == nil {
+		data, err := os.ReadFile(t.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, false, nil
+		}
+
+		return data, err == nil, err
+	}
+
+	// the marker tells an empty file from a missing one
+	p := shellQuotePath(t.path)
+	script := "[ -e " + p + " ] || exit 0; printf x && cat -- " + p
+
+	var stdout, stderr bytes.Buffer
+	if err := c.transport(*t.host).Run(ctx, "sh -c "+shellQuotePosix(script), nil, &stdout, &stderr); err != nil {
+		return nil, false, commandError(err, stderr.String())
+	}
+
+	data, ok := bytes.CutPrefix(stdout.Bytes(), []byte("x"))
+
+	return data, ok, nil
+}
+
+// fileAttrs are the permissions and ownership of an existing file, with the
+// owner and group both by id and by name.
+type fileAttrs struct {
+	mode       fs.FileMode
+	uid, user  string
+	gid, group string
+}
+
+// statTarget returns the attributes of t, which must exist. It uses stat(1)
+// for local files too, to get the owner by name on any unix.
+func (c *Ctx) statTarget(ctx context.Context, t fileTarget) (fileAttrs, error) {
+	// GNU stat, then the BSD one
+	p := shellQuotePath(t.path)
+	script := "stat -c '%a %u %U %g %G' -- " + p + " 2>/dev/null || stat -f '%Lp %u %Su %g %Sg' -- " + p
+
+	var (
+		stdout, stderr bytes.Buffer
+		err            error
+	)
+
+	if t.host == nil {
+		cmd := command(ctx, "sh", "-c", script)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err = cmd.Run()
+	} else {
+		err = c.transport(*t.host).Run(ctx, "sh -c "+shellQuotePosix(script), nil, &stdout, &stderr)
+	}
+
+	if err != nil {
+		return fileAttrs{}, commandError(err, stderr.String())
+	}
+
+	f := strings.Fields(stdout.String())
+	if len(f) != 5 {
+		return fileAttrs{}, fmt.Errorf("%s: unexpected stat output %q", t, stdout.String())
+	}
+
+	mode, err := strconv.ParseUint(f[0], 8, 32)
+	if err != nil {
+		return fileAttrs{}, fmt.Errorf("%s: unexpected stat output %q", t, stdout.String())
+	}
+
+	return fileAttrs{mode: fs.FileMode(mode) & fs.ModePerm, uid: f[1], user: f[2], gid: f[3], group: f[4]}, nil
+}
+
+// attrsDiff describes the mode and owner changes fo makes to a file with
+// attributes a, as git does in the header of a diff. It is empty when fo
+// changes nothing.
+func (a fileAttrs) attrsDiff(fo fileOptions) string {
+	var b strings.Builder
+
+	if fo.mode != nil && *fo.mode != a.mode {
+		fmt.Fprintf(&b, "old mode %04o\nnew mode %04o\n", a.mode, *fo.mode)
+	}
+
+	if fo.owner != "" {
+		user, group, hasGroup := strings.Cut(fo.owner, ":")
+		if (user != a.user && user != a.uid) || (hasGroup && group != a.group && group != a.gid) {
+			fmt.Fprintf(&b, "old owner %s:%s\nnew owner %s\n", a.user, a.group, fo.owner)
+		}
+	}
+
+	return b.String()
+}
+
+// writeTarget replaces the contents of t when data is set, creating missing
+// parent directories, then applies mode and owner when they are set.
+func (c *Ctx) writeTarget(ctx context.Context, t fileTarget, data []byte, fo fileOptions) error {
+	if t.host == nil {
+		if data != nil {
+			if err := mkdirAll(filepath.Dir(t.path)); err != nil {
+				return err
+			}
+
+			if err := os.WriteFile(t.path, data, 0o644); err != nil {
+				return err
+			}
+		}
+
+		if fo.mode != nil {
+			if err := os.Chmod(t.path, *fo.mode); err != nil {
+				return err
+			}
+		}
+
+		if fo.owner != "" {
+			var stderr bytes.Buffer
+
+			cmd := command(ctx, "chown", fo.owner, t.path)
+			cmd.Stderr = &stderr
+
+			if err := cmd.Run(); err != nil {
+				return commandError(err, stderr.String())
+			}
+		}
+
+		return nil
+	}
+
+	p := shellQuotePath(t.path)
+	script := "true"
+
+	var stdin io.Reader
+
+	if data != nil {
+		script = "mkdir -p " + shellQuotePath(remoteDir(t.path)) + " && cat > " + p
+		stdin = bytes.NewReader(data)
+	}
+
+	if fo.mode != nil {
+		script += fmt.Sprintf(" && chmod %o %s", *fo.mode, p)
+	}
+
+	if fo.owner != "" {
+		script += " && chown " + shellQuotePosix(fo.owner) + " " + p
+	}
+
+	var stderr bytes.Buffer
+	if err := c.transport(*t.host).Run(ctx, "sh -c "+shellQuotePosix(script), stdin, io.Discard, &stderr); err != nil {
+		return commandError(err, stderr.String())
+	}
+
+	return nil
+}
+
+// commandError adds what a failed command printed to err, keeping err
+// wrapped so its exit code is still reported.
+func commandError(err error, stderr string) error {
+	if msg := strings.TrimSpace(stderr); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+
+	return err
+}
+
+// fileChange is the outcome of writing a file.
+type fileChange struct {
+	changed bool
+	diff    string
+}
+
+// putContents writes data to dst and applies the mode and owner in fo,
+// skipping whatever already matches, and diffs the old and new state. Under
+// dry-run nothing is written and the diff is streamed instead.
+func (c *Ctx) putContents(ctx context.Context, dst fileTarget, data []byte, fo fileOptions, dryRun bool, onLine lineFunc) (fileChange, error) {
+	old, exists, err := c.readTarget(ctx, dst)
+	if err != nil {
+		return fileChange{}, err
+	}
+
+	from := dst.String()
+	if !exists {
+		from = "/dev/null"
+	}
+
+	contentChanged := !exists || !bytes.Equal(old, data)
+
+	// mode and owner only count as a change when they differ
+	var attrs string
+
+	if exists && (fo.mode != nil || fo.owner != "") {
+		current, err := c.statTarget(ctx, dst)
+		if err != nil {
+			return fileChange{}, err
+		}
+
+		attrs = current.attrsDiff(fo)
+	}
+
+	change := fileChange{
+		changed: contentChanged || attrs != "",
+		diff:    attrs + unifiedDiff(from, dst.String(), old, data),
+	}
+
+	if dryRun {
+		if onLine != nil {
+			for line := range strings.SplitSeq(strings.TrimSuffix(change.diff, "\n"), "\n") {
+				if line != "" {
+					onLine("diff", line)
+				}
+			}
+		}
+
+		return change, nil
+	}
+
+	if data == nil {
+		data = []byte{}
+	}
+
+	if !change.changed {
+		return change, nil
+	}
+
+	// only the mode and owner need fixing
+	if !contentChanged {
+		data = nil
+	}
+
+	return change, c.writeTarget(ctx, dst, data, fo)
+}
+
+// fileOp runs one file primitive with the op events and retries shared by
+// all of them. attempt does the work and reports what it changed, streaming
+// any diff to onLine.
+func (c *Ctx) fileOp(op string, fields map[string]any, opts opOptions,
+	attempt func(ctx context.Context, dryRun bool, onLine lineFunc) (fileChange, error),
+) (cmdResult, fileChange) {
+	dryRun := c.dryRun || opts.file.dryRun
+
+	start := time.Now()
+	opID := c.newOpID()
+
+	startFields := map[string]any{"op": op, "dry_run": dryRun}
+	maps.Copy(startFields, fields)
+
+	c.emit(events.OpStart, opID, startFields)
+
+	var change fileChange
+
+	host, _ := fields["host"].(string)
+	onLine := c.lineSink(opts, opID, op, host)
+
+	res := runWithRetry(c.ctx, opts, func(ctx context.Context, _, _ io.Writer) error {
+		var err error
+
+		change, err = attempt(ctx, dryRun, onLine)
+
+		return err
+	}, nil)
+
+	if res.err != nil {
+		res.stderr = res.err.Error()
+	}
+
+	endFields := map[string]any{
+		"op":          op,
+		"ok":          res.ok(),
+		"code":        res.code,
+		"changed":     change.changed,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"attempts":    res.attempts,
+		"timed_out":   res.timedOut,
+		"dry_run":     dryRun,
+	}
+	maps.Copy(endFields, fields)
+
+	c.emit(events.OpEnd, opID, endFields)
+
+	return res, change
+}
+
+// pushFileResult pushes the result table of a file primitive, raising in
+// strict mode when it failed.
+func (c *Ctx) pushFileResult(L *lua.LState, opts opOptions, op, desc string, res cmdResult, change fileChange) int {
+	c.checkResult(L, opts, op, "", desc, res)
+
+	tbl := cmdResultTable(L, res)
+	L.SetField(tbl, "changed", lua.LBool(change.changed))
+	L.SetField(tbl, "diff", lua.LString(change.diff))
+	L.Push(tbl)
+
+	return 1
+}
+
+// fileOpError reports a problem found before a file op could start.
+func (c *Ctx) fileOpError(L *lua.LState, opts opOptions, op string, err error) int {
+	res := cmdResult{code: 1, err: err, stderr: err.Error()}
+
+	return c.pushFileResult(L, opts, op, op, res, fileChange{})
+}
+
+// ctx:read_file(path) -> "contents"
+func (c *Ctx) luaReadFile(L *lua.LState) int {
+	spec := L.CheckString(2)
+
+	opts, err := parseOpOptions(L.OptTable(3, nil), readFileOpKeys)
+	if err != nil {
+		L.ArgError(3, err.Error())
+		return 1
+	}
+
+	paths, err := c.interpolateHostPaths(opts, spec)
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return 1
+	}
+
+	src := c.resolveFileTarget(paths[0])
+
+	var data []byte
+
+	res, _ := c.fileOp("read_file", map[string]any{"path": src.String(), "host": src.alias}, opts,
+		func(ctx context.Context, _ bool, _ lineFunc) (fileChange, error) {
+			var (
+				exists bool
+				err    error
+			)
+
+			data, exists, err = c.readTarget(ctx, src)
+			if err == nil && !exists {
+				err = fmt.Errorf("%s: %w", src, fs.ErrNotExist)
+			}
+
+			return fileChange{}, err
+		})
+
+	if !res.ok() {
+		L.RaiseError("read_file %s: %v", src, res.err)
+		return 0
+	}
+
+	L.Push(lua.LString(data))
+
+	return 1
+}
+
+// ctx:write_file(path, content[, opts]) -> { ok=true, changed=true, diff="...", ... }
+func (c *Ctx) luaWriteFile(L *lua.LState) int {
+	spec := L.CheckString(2)
+	content := L.CheckString(3)
+
+	opts, err := parseOpOptions(L.OptTable(4, nil), fileOpKeys)
+	if err != nil {
+		L.ArgError(4, err.Error())
+		return 1
+	}
+
+	paths, err := c.interpolateHostPaths(opts, spec)
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return 1
+	}
+
+	dst := c.resolveFileTarget(paths[0])
+
+	res, change := c.fileOp("write_file", map[string]any{"path": dst.String(), "host": dst.alias}, opts,
+		func(ctx context.Context, dryRun bool, onLine lineFunc) (fileChange, error) {
+			return c.putContents(ctx, dst, []byte(content), opts.file, dryRun, onLine)
+		})
+
+	return c.pushFileResult(L, opts, "write_file", "write_file "+dst.String(), res, change)
+}
+
+// ctx:put(src, dst[, opts]) -> { ok=true, changed=true, diff="...", ... }
+func (c *Ctx) luaPut(L *lua.LState) int {
+	return c.luaCopyFile(L, "put")
+}
+
+// ctx:get(src, dst[, opts]) -> { ok=true, changed=true, diff="...", ... }
+func (c *Ctx) luaGet(L *lua.LState) int {
+	return c.luaCopyFile(L, "get")
+}
+
+// luaCopyFile copies a single file: put sends a local file anywhere, get
+// brings a file from anywhere to a local path. A dst ending in a slash is a
+// directory that receives the file under its own name.
+func (c *Ctx) luaCopyFile(L *lua.LState, op string) int {
+	srcSpec := L.CheckString(2)
+	dstSpec := L.CheckString(3)
+
+	opts, err := parseOpOptions(L.OptTable(4, nil), fileOpKeys)
+	if err != nil {
+		L.ArgError(4, err.Error())
+		return 1
+	}
+
+	paths, err := c.interpolateHostPaths(opts, srcSpec, dstSpec)
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return 1
+	}
+
+	src := c.resolveFileTarget(paths[0])
+	dst := c.resolveFileTarget(paths[1])
+
+	switch {
+	case op == "put" && src.host != nil:
+		return c.fileOpError(L, opts, op, errors.New("put copies a local file, use get to copy from a host"))
+	case op == "get" && dst.host != nil:
+		return c.fileOpError(L, opts, op, errors.New("get copies to a local path, use put to copy to a host"))
+	}
+
+	if strings.HasSuffix(dst.path, "/") {
+		dst.path += filepath.Base(src.path)
+	}
+
+	host := dst.alias
+	if op == "get" {
+		host = src.alias
+	}
+
+	fields := map[string]any{"src": src.String(), "dst": dst.String(), "host": host}
+
+	res, change := c.fileOp(op, fields, opts, func(ctx context.Context, dryRun bool, onLine lineFunc) (fileChange, error) {
+		data, exists, err := c.readTarget(ctx, src)
+		if err != nil {
+			return fileChange{}, err
+		}
+
+		if !exists {
+			return fileChange{}, fmt.Errorf("%s: %w", src, fs.ErrNotExist)
+		}
+
+		// a put keeps the mode of the local file unless one is given
+		fo := opts.file
+		if fo.mode == nil && src.host == nil {
+			if info, err := os.Stat(src.path); err == nil {
+				mode := info.Mode().Perm()
+				fo.mode = &mode
+			}
+		}
+
+		return c.putContents(ctx, dst, data, fo, dryRun, onLine)
+	})
+
+	return c.pushFileResult(L, opts, op, op+" "+src.String()+" -> "+dst.String(), res, change)
+}
+
+// ctx:template(src, dst[, vars[, opts]]) -> { ok=true, changed=true, diff="...", ... }
+func (c *Ctx) luaTemplate(L *lua.LState) int {
+	srcPath := L.CheckString(2)
+	dstSpec := L.CheckString(3)
+
+	vars, ok := goFromLua(L.OptTable(4, L.NewTable())).(map[string]any)
+	if !ok {
+		L.ArgError(4, "vars must be a table keyed by name")
+		return 1
+	}
+
+	opts, err := parseOpOptions(L.OptTable(5, nil), templateOpKeys)
+	if err != nil {
+		L.ArgError(5, err.Error())
+		return 1
+	}
+
+	paths, err := c.interpolateHostPaths(opts, srcPath, dstSpec)
+	if err != nil {
+		L.ArgError(3, err.Error())
+		return 1
+	}
+
+	src := paths[0]
+	dst := c.resolveFileTarget(paths[1])
+
+	if isRemoteSpec(src) {
+		return c.fileOpError(L, opts, "template", errors.New("template sources must be local files"))
+	}
+
+	// the vars passed in win over those of the target host
+	data := map[string]any{}
+	if dst.host != nil {
+		data = hostVars(dst.alias, *dst.host)
+	}
+
+	maps.Copy(data, vars)
+
+	fields := map[string]any{"src": src, "dst": dst.String(), "host": dst.alias}
+
+	res, change := c.fileOp("template", fields, opts, func(ctx context.Context, dryRun bool, onLine lineFunc) (fileChange, error) {
+		out, err := renderTemplate(src, opts.file.engine, data)
+		if err != nil {
+			return fileChange{}, err
+		}
+
+		return c.putContents(ctx, dst, out, opts.file, dryRun, onLine)
+	})
+
+	return c.pushFileResult(L, opts, "template", "template "+src+" -> "+dst.String(), res, change)
+}
+
+// renderTemplate renders the local file src with data.
+func renderTemplate(src, engine string, data map[string]any) ([]byte, error) {
+	text, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if engine == templateInterpolate {
+		out, err := interpolate(string(text), data, true)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src, err)
+		}
+
+		return []byte(out), nil
+	}
+
+	tmpl, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
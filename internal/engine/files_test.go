@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/pix-xip/weave/internal/events"
+)
+
+func TestFilePrimitives(t *testing.T) {
+	fakeSSH(t)
+
+	local := t.TempDir()
+	writeTree(t, local, map[string]string{
+		"app.conf.tmpl": "listen {{ .addr }}:{{ .port }}\nname {{ .host }}\n",
+		"motd.tmpl":     "welcome to {{ host }} ({{ env }})\n",
+		"run.sh":        "#!/bin/sh\n",
+	})
+
+	remote := t.TempDir()
+	fetched := t.TempDir()
+	uid := strconv.Itoa(os.Getuid())
+
+	err := runWeavefile(t, `
+config = {
+  ssh_multiplex = false,
+  hosts = { box = { addr = "box.example.com", vars = { root = "`+remote+`", env = "prod" } } },
+}
+
+task("files", function(ctx)
+  local r = ctx:template("`+local+`/app.conf.tmpl", "box:{{ root }}/etc/app.conf", { port = 8080 }, { mode = "0600" })
+  assert(r.ok and r.changed, "template failed: " .. r.err)
+  assert(string.find(r.diff, "+listen box.example.com:8080", 1, true), "unexpected diff: " .. r.diff)
+
+  r = ctx:template("`+local+`/app.conf.tmpl", "box:{{ root }}/etc/app.conf", { port = 8080 })
+  assert(r.ok and not r.changed and r.diff == "", "expected no change: " .. r.diff)
+
+  r = ctx:template("`+local+`/app.conf.tmpl", "box:{{ root }}/etc/app.conf", { port = 8080 }, { mode = "0600", owner = "`+uid+`" })
+  assert(r.ok and not r.changed and r.diff == "", "expected the same mode and owner to be no change: " .. r.err .. r.diff)
+
+  r = ctx:template("`+local+`/app.conf.tmpl", "box:{{ root }}/etc/app.conf", { port = 8080 }, { mode = "0640", dry_run = true })
+  assert(r.ok and r.changed and r.diff == "old mode 0600\nnew mode 0640\n", "expected a pending mode change: " .. r.diff)
+
+  r = ctx:template("`+local+`/app.conf.tmpl", "box:{{ root }}/etc/app.conf", { port = 8080 }, { mode = "0640" })
+  assert(r.ok and r.changed and r.diff == "old mode 0600\nnew mode 0640\n", "expected a mode change: " .. r.diff)
+
+  r = ctx:template("`+local+`/app.conf.tmpl", "box:{{ root }}/etc/app.conf", { port = 8080 }, { mode = "0600" })
+  assert(r.ok and r.changed, "expected the mode to be restored: " .. r.err)
+
+  r = ctx:template("`+local+`/motd.tmpl", "box:{{ root }}/etc/motd", {}, { engine = "interpolate" })
+  assert(r.ok, "interpolate template failed: " .. r.err)
+
+  r = ctx:put("`+local+`/run.sh", "box:{{ root }}/bin/")
+  assert(r.ok and r.changed, "put failed: " .. r.err)
+
+  r = ctx:get("box:{{ root }}/etc/motd", "`+fetched+`/motd")
+  assert(r.ok and r.changed, "get failed: " .. r.err)
+
+  assert(ctx:read_file("box:{{ root }}/etc/motd") == "welcome to box (prod)\n", "unexpected remote read")
+  assert(ctx:read_file("`+fetched+`/motd") == "welcome to box (prod)\n", "unexpected local read")
+
+  r = ctx:write_file("box:`+fetched+`/{{ env }}", "raw\n", { interpolate = false })
+  assert(r.ok and r.changed, "uninterpolated write_file failed: " .. r.err)
+  assert(ctx:read_file("`+fetched+`/{{ env }}") == "raw\n", "expected the placeholder to be kept in the path")
+
+  r = ctx:write_file("`+fetched+`/empty", "")
+  assert(r.ok and r.changed, "write_file failed: " .. r.err)
+  r = ctx:write_file("`+fetched+`/empty", "")
+  assert(r.ok and not r.changed, "expected empty file to be unchanged")
+
+  local ok, msg = pcall(function() ctx:read_file("box:{{ root }}/missing") end)
+  assert(not ok and string.find(msg, "file does not exist", 1, true), "expected missing file error: " .. tostring(msg))
+
+  ok, msg = pcall(function() ctx:template("`+local+`/app.conf.tmpl", "box:/tmp/x", {}, { check = true }) end)
+  assert(not ok and string.find(msg, "port", 1, true), "expected missing key error: " .. tostring(msg))
+
+  ok, msg = pcall(function() ctx:put("box:/etc/hosts", "/tmp/hosts", { check = true }) end)
+  assert(not ok and string.find(msg, "use get", 1, true), "expected direction error: " .. tostring(msg))
+end)
+`, Options{}, "files")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	want := map[string]string{
+		"etc/app.conf": "listen box.example.com:8080\nname box\n",
+		"etc/motd":     "welcome to box (prod)\n",
+		"bin/run.sh":   "#!/bin/sh\n",
+	}
+	if got := readTree(t, remote); !equalTree(got, want) {
+		t.Fatalf("unexpected remote tree %v", got)
+	}
+
+	for name, mode := range map[string]os.FileMode{"etc/app.conf": 0o600, "bin/run.sh": 0o640} {
+		info, err := os.Stat(filepath.Join(remote, name))
+		if err != nil || info.Mode().Perm() != mode {
+			t.Fatalf("expected %s to have mode %v, got %v (%v)", name, mode, info.Mode(), err)
+		}
+	}
+}
+
+func TestFileOpsDryRunShowsDiff(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"app.conf": "a\nb\n"})
+
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("preview", function(ctx)
+  local r = ctx:write_file("`+dir+`/app.conf", "a\nc\n")
+  assert(r.ok and r.changed, "expected a change")
+  r = ctx:write_file("`+dir+`/new.conf", "x\n", { dry_run = true })
+  assert(r.ok and r.changed, "expected a new file")
+end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true, DryRun: true})
+	defer e.Close()
+
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+
+	e.bus.Subscribe(func(ev events.Event) {
+		if ev.Type == events.Output && ev.Fields["stream"] == "diff" {
+			mu.Lock()
+			lines = append(lines, strField(ev.Fields, "line"))
+			mu.Unlock()
+		}
+	})
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := e.Run(context.Background(), []string{"preview"}, RunArgs{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	want := []string{
+		"--- " + dir + "/app.conf", "+++ " + dir + "/app.conf", "@@ -1,2 +1,2 @@", " a", "-b", "+c",
+		"--- /dev/null", "+++ " + dir + "/new.conf", "@@ -0,0 +1,1 @@", "+x",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected diff lines:\n%s", strings.Join(lines, "\n"))
+	}
+
+	if got := readTree(t, dir); got["app.conf"] != "a\nb\n" || got["new.conf"] != "" {
+		t.Fatalf("dry-run changed files: %v", got)
+	}
+}
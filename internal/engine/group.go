@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var errHostSkipped = errors.New("skipped")
+
+// hostResult is the outcome of a fan-out command on a single group member.
+type hostResult struct {
+	cmdResult
+
+	host    string
+	skipped bool // never started because of max_failures or cancellation
+}
+
+// ctx:run("@web", cmd[, opts]) -> { ok=true, failed=0, skipped=0, hosts={ web1={...}, ... } }
+func (c *Ctx) luaRunGroup(L *lua.LState, group, cmdstr string, optsTbl *lua.LTable, optsIdx int) int {
+	members, ok := c.cfg.Groups[group]
+	if !ok {
+		L.ArgError(2, "unknown host group: @"+group)
+		return 1
+	}
+
+	opts, err := parseOpOptions(optsTbl, groupOpKeys)
+	if err != nil {
+		L.ArgError(optsIdx, err.Error())
+		return 1
+	}
+
+	// every member gets the command filled in from its own vars
+	cmds := make(map[string]string, len(members))
+
+	for _, name := range members {
+		if !opts.interpolate {
+			cmds[name] = cmdstr
+			continue
+		}
+
+		cmds[name], err = interpolate(cmdstr, hostVars(name, c.cfg.Hosts[name]), false)
+		if err != nil {
+			L.ArgError(3, name+": "+err.Error())
+			return 1
+		}
+	}
+
+	results := c.runFanOut(members, cmds, opts)
+
+	hosts := L.NewTable()
+	failed, skipped := 0, 0
+
+	for _, r := range results {
+		tbl := cmdResultTable(L, r.cmdResult)
+		L.SetField(tbl, "skipped", lua.LBool(r.skipped))
+		L.SetField(hosts, r.host, tbl)
+
+		switch {
+		case r.skipped:
+			skipped++
+		case !r.ok():
+			failed++
+		}
+	}
+
+	c.checkGroupResult(L, opts, group, cmdstr, results)
+
+	res := L.NewTable()
+	L.SetField(res, "ok", lua.LBool(failed == 0 && skipped == 0))
+	L.SetField(res, "failed", lua.LNumber(failed))
+	L.SetField(res, "skipped", lua.LNumber(skipped))
+	L.SetField(res, "hosts", hosts)
+	L.Push(res)
+
+	return 1
+}
+
+// runFanOut runs each member's command from cmds, at most opts.parallel at
+// a time and in rolling batches of opts.batch hosts. Once opts.maxFailures
+// hosts have failed no new hosts are started. Results are in member order.
+func (c *Ctx) runFanOut(members []string, cmds map[string]string, opts opOptions) []hostResult {
+	results := make([]hostResult, len(members))
+
+	parallel := opts.parallel
+	if parallel <= 0 || parallel > len(members) {
+		parallel = len(members)
+	}
+
+	batch := opts.batch
+	if batch <= 0 {
+		batch = len(members)
+	}
+
+	var (
+		mu       sync.Mutex
+		failures int
+	)
+
+	stop := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return c.ctx.Err() != nil || (opts.maxFailures > 0 && failures >= opts.maxFailures)
+	}
+
+	for start := 0; start < len(members); start += batch {
+		end := min(start+batch, len(members))
+		sem := make(chan struct{}, parallel)
+
+		var wg sync.WaitGroup
+
+		for i := start; i < end; i++ {
+			name := members[i]
+
+			// take a slot before checking so failures of running hosts are seen
+			sem <- struct{}{}
+
+			if stop() {
+				<-sem
+
+				results[i] = hostResult{host: name, skipped: true, cmdResult: cmdResult{err: errHostSkipped}}
+
+				continue
+			}
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				host := c.cfg.Hosts[name]
+				res := c.runCommand(name, &host, cmds[name], opts)
+
+				if !res.ok() {
+					mu.Lock()
+					failures++
+					mu.Unlock()
+				}
+
+				results[i] = hostResult{host: name, cmdResult: res}
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	return results
+}
+
+// checkGroupResult is the fan-out counterpart of checkResult, raising one
+// error that names every failed or skipped host.
+func (c *Ctx) checkGroupResult(L *lua.LState, opts opOptions, group, cmdstr string, results []hostResult) {
+	check := c.strict
+	if opts.check != nil {
+		check = *opts.check
+	}
+
+	if !check {
+		return
+	}
+
+	var (
+		failures []string
+		tails    []string
+	)
+
+	for _, r := range results {
+		switch {
+		case r.skipped:
+			failures = append(failures, r.host+": skipped")
+		case !r.ok():
+			failures = append(failures, fmt.Sprintf("%s: exit %d", r.host, r.code))
+
+			if tail := tailLines(r.stderr, stderrTailLines); tail != "" {
+				tails = append(tails, "["+r.host+"]\n"+tail)
+			}
+		}
+	}
+
+	if len(failures) == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("run failed on %d of %d hosts in @%s (%s): %s",
+		len(failures), len(results), group, strings.Join(failures, ", "), cmdstr)
+	if len(tails) > 0 {
+		msg += "\n" + strings.Join(tails, "\n")
+	}
+
+	L.RaiseError("%s", msg)
+}
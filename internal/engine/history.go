@@ -0,0 +1,431 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pix-xip/weave/internal/events"
+)
+
+const (
+	// stateDirName is the directory next to the Weavefile runs and task
+	// fingerprints are kept in.
+	stateDirName = ".weave"
+	// historyLimit is the number of runs kept, older ones are removed.
+	historyLimit = 50
+)
+
+// Run statuses recorded in the history.
+const (
+	runIncomplete = "incomplete" // still running, or weave was killed
+	runSucceeded  = "succeeded"
+	runFailed     = "failed"
+	runCancelled  = "cancelled"
+)
+
+// runRecord is the run.json of a recorded run.
+type runRecord struct {
+	ID            string            `json:"run_id"`
+	Start         time.Time         `json:"start"`
+	DurationMS    int64             `json:"duration_ms"`
+	Status        string            `json:"status"`
+	Targets       []string          `json:"targets"`
+	Params        map[string]string `json:"params,omitempty"`
+	Args          []string          `json:"args,omitempty"`
+	Weavefile     string            `json:"weavefile"`
+	WeavefileHash string            `json:"weavefile_sha256"`
+	Error         string            `json:"error,omitempty"`
+	Report        *runReport        `json:"report,omitempty"`
+}
+
+// historyRecorder writes the events and outcome of one run to its
+// directory under .weave/runs.
+type historyRecorder struct {
+	root        string
+	dir         string
+	file        *os.File
+	events      *events.JSONLWriter
+	unsubscribe func()
+	record      runRecord
+}
+
+// stateDir is the state directory of the Weavefile at file.
+func stateDir(file string) string {
+	return filepath.Join(filepath.Dir(file), stateDirName)
+}
+
+// ensureStateDir creates the subdirectory sub of the state directory root,
+// keeping the state directory out of version control.
+func ensureStateDir(root, sub string) error {
+	if err := os.MkdirAll(filepath.Join(root, sub), 0o750); err != nil {
+		return err
+	}
+
+	ignore := filepath.Join(root, ".gitignore")
+	if _, err := os.Stat(ignore); errors.Is(err, fs.ErrNotExist) {
+		return os.WriteFile(ignore, []byte("*\n"), 0o644)
+	}
+
+	return nil
+}
+
+// startHistory starts recording the run. The record is written straight
+// away so a run that never finishes still shows up as incomplete.
+func (e *Engine) startHistory(run *runState, names []string, start time.Time) (*historyRecorder, error) {
+	root := stateDir(e.opt.File)
+	dir := filepath.Join(root, "runs", run.id)
+
+	if err := ensureStateDir(root, filepath.Join("runs", run.id)); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(e.opt.File)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+
+	weavefile, err := filepath.Abs(e.opt.File)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(filepath.Join(dir, "events.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	h := &historyRecorder{
+		root:   root,
+		dir:    dir,
+		file:   f,
+		events: events.NewJSONLWriter(f),
+		record: runRecord{
+			ID:            run.id,
+			Start:         start,
+			Status:        runIncomplete,
+			Targets:       names,
+			Params:        run.args.Params,
+			Args:          run.args.Extra,
+			Weavefile:     weavefile,
+			WeavefileHash: hex.EncodeToString(sum[:]),
+		},
+	}
+
+	if err := h.writeRecord(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	h.unsubscribe = e.bus.Subscribe(h.events.Handle)
+
+	return h, nil
+}
+
+// finish stops recording and stores the outcome of the run, then prunes
+// the oldest runs.
+func (h *historyRecorder) finish(ctx context.Context, report *runReport, runErr error) error {
+	h.unsubscribe()
+
+	err := errors.Join(h.events.Err(), h.file.Close())
+
+	h.record.DurationMS = time.Since(h.record.Start).Milliseconds()
+	h.record.Report = report
+	h.record.Status = runSucceeded
+
+	switch {
+	case ctx.Err() != nil:
+		h.record.Status = runCancelled
+	case runErr != nil:
+		h.record.Status = runFailed
+	}
+
+	if runErr != nil {
+		h.record.Error = runErr.Error()
+	}
+
+	return errors.Join(err, h.writeRecord(), pruneHistory(h.root, historyLimit))
+}
+
+func (h *historyRecorder) writeRecord() error {
+	data, err := json.MarshalIndent(h.record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(h.dir, "run.json"), append(data, '\n'), 0o644)
+}
+
+// runIDs lists the recorded runs, newest first.
+func runIDs(root string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "runs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+
+	for _, ent := range entries {
+		if ent.IsDir() {
+			ids = append(ids, ent.Name())
+		}
+	}
+
+	// run IDs start with their UTC start time, so they sort by age
+	slices.Sort(ids)
+	slices.Reverse(ids)
+
+	return ids, nil
+}
+
+func pruneHistory(root string, keep int) error {
+	ids, err := runIDs(root)
+	if err != nil || len(ids) <= keep {
+		return err
+	}
+
+	var errs []error
+
+	for _, id := range ids[keep:] {
+		errs = append(errs, os.RemoveAll(filepath.Join(root, "runs", id)))
+	}
+
+	return errors.Join(errs...)
+}
+
+func readRunRecord(root, id string) (runRecord, error) {
+	var rec runRecord
+
+	data, err := os.ReadFile(filepath.Join(root, "runs", id, "run.json"))
+	if err != nil {
+		return rec, err
+	}
+
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("run %s: %w", id, err)
+	}
+
+	return rec, nil
+}
+
+// History writes the most recent runs of the Weavefile, newest first, at
+// most limit of them when limit is positive.
+func (e *Engine) History(w io.Writer, limit int) error {
+	root := stateDir(e.opt.File)
+
+	ids, err := runIDs(root)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		_, err := fmt.Fprintln(w, "No runs recorded yet.")
+		return err
+	}
+
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTARTED\tDURATION\tSTATUS\tTASKS\tFAILED")
+
+	for _, id := range ids {
+		rec, err := readRunRecord(root, id)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t\t\tunreadable\t\t\n", id)
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			rec.ID,
+			rec.Start.Local().Format(time.DateTime),
+			formatDuration(rec.DurationMS),
+			rec.Status,
+			strings.Join(rec.Targets, ", "),
+			strings.Join(rec.failedTasks(), ", "),
+		)
+	}
+
+	return tw.Flush()
+}
+
+func (rec runRecord) failedTasks() []string {
+	var out []string
+
+	if rec.Report == nil {
+		return out
+	}
+
+	for _, t := range rec.Report.Tasks {
+		if t.Status == StatusFailed || t.Status == StatusCancelled {
+			out = append(out, t.Name)
+		}
+	}
+
+	return out
+}
+
+// resolveRunID finds a recorded run by its ID, a unique prefix of it, or
+// "last" for the most recent run.
+func resolveRunID(root, ref string) (string, error) {
+	ids, err := runIDs(root)
+	if err != nil {
+		return "", err
+	}
+
+	if ref == "last" && len(ids) > 0 {
+		return ids[0], nil
+	}
+
+	var matches []string
+
+	for _, id := range ids {
+		if id == ref {
+			return id, nil
+		}
+
+		if strings.HasPrefix(id, ref) {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no recorded run %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("run %q is ambiguous, it matches %s", ref, strings.Join(matches, ", "))
+	}
+}
+
+// ShowRun writes the details of a recorded run followed by the output it
+// captured, only that of task when it is set.
+func (e *Engine) ShowRun(w io.Writer, ref, task string) error {
+	root := stateDir(e.opt.File)
+
+	id, err := resolveRunID(root, ref)
+	if err != nil {
+		return err
+	}
+
+	rec, err := readRunRecord(root, id)
+	if err != nil {
+		return err
+	}
+
+	if task != "" && rec.Report != nil && !slices.ContainsFunc(rec.Report.Tasks, func(t taskReport) bool {
+		return t.Name == task
+	}) {
+		return fmt.Errorf("task %q did not take part in run %s", task, id)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Run:\t%s\n", rec.ID)
+	fmt.Fprintf(tw, "Started:\t%s\n", rec.Start.Local().Format(time.DateTime))
+	fmt.Fprintf(tw, "Duration:\t%s\n", formatDuration(rec.DurationMS))
+	fmt.Fprintf(tw, "Status:\t%s\n", rec.Status)
+	fmt.Fprintf(tw, "Tasks:\t%s\n", strings.Join(rec.Targets, ", "))
+
+	if len(rec.Params) > 0 {
+		params := make([]string, 0, len(rec.Params))
+		for k, v := range rec.Params {
+			params = append(params, k+"="+v)
+		}
+
+		slices.Sort(params)
+		fmt.Fprintf(tw, "Params:\t%s\n", strings.Join(params, " "))
+	}
+
+	if len(rec.Args) > 0 {
+		fmt.Fprintf(tw, "Args:\t%s\n", strings.Join(rec.Args, " "))
+	}
+
+	fmt.Fprintf(tw, "Weavefile:\t%s (sha256 %s)\n", rec.Weavefile, rec.WeavefileHash)
+
+	if rec.Error != "" {
+		fmt.Fprintf(tw, "Error:\t%s\n", rec.Error)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if rec.Report != nil {
+		fmt.Fprintln(w)
+
+		if err := rec.Report.writeText(w); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(w)
+
+	return replayOutput(w, filepath.Join(root, "runs", id, "events.jsonl"), task)
+}
+
+// replayOutput writes the output lines, log messages and task errors
+// recorded in an events file the way they were shown during the run.
+func replayOutput(w io.Writer, path, task string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for sc.Scan() {
+		var rec events.Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if task != "" && rec.Task != task {
+			continue
+		}
+
+		var line string
+
+		switch rec.Type {
+		case events.Output:
+			line = fmt.Sprintf("%s | %s", strField(rec.Fields, "prefix"), strField(rec.Fields, "line"))
+		case events.Message:
+			line = fmt.Sprintf("%s | [%s] %s", rec.Task, strField(rec.Fields, "level"), strField(rec.Fields, "msg"))
+		case events.TaskEnd:
+			if msg := strField(rec.Fields, "error"); msg != "" {
+				line = fmt.Sprintf("%s | error: %s", rec.Task, msg)
+			}
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return sc.Err()
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestRunHistory(t *testing.T) {
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("build", function(ctx) ctx:run("echo building " .. ctx.params.version) end)
+task("deploy", { depends = { "build" } }, function(ctx)
+  ctx:log("info", "deploying")
+  ctx:run("echo nope >&2; exit 4", { check = true })
+end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true})
+	defer e.Close()
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	args := RunArgs{Params: map[string]string{"version": "1.2"}, Extra: []string{"--verbose"}}
+	if err := e.Run(context.Background(), []string{"build"}, args); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := e.Run(context.Background(), []string{"deploy"}, args); err == nil {
+		t.Fatalf("expected deploy to fail")
+	}
+
+	var buf bytes.Buffer
+	if err := e.History(&buf, 0); err != nil {
+		t.Fatalf("History: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "failed") || !strings.HasSuffix(strings.TrimSpace(lines[1]), "deploy") ||
+		!strings.Contains(lines[2], "succeeded") {
+		t.Fatalf("unexpected history:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := e.ShowRun(&buf, "last", ""); err != nil {
+		t.Fatalf("ShowRun: %v", err)
+	}
+
+	for _, want := range []string{
+		"Status:     failed", "Params:     version=1.2", "Args:       --verbose",
+		"build | building 1.2", "deploy | [info] deploying", "deploy | nope", "deploy | error: ",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %q in:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := e.ShowRun(&buf, "last", "build"); err != nil {
+		t.Fatalf("ShowRun: %v", err)
+	}
+
+	if out := buf.String(); !strings.Contains(out, "build | building") || strings.Contains(out, "deploy |") {
+		t.Fatalf("expected only the output of build:\n%s", out)
+	}
+
+	if err := e.ShowRun(&buf, "nope", ""); err == nil {
+		t.Fatalf("expected an unknown run error")
+	}
+
+	e.opt.NoHistory = true
+	if err := e.Run(context.Background(), []string{"build"}, args); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if ids, _ := runIDs(stateDir(weavefile)); len(ids) != 2 {
+		t.Fatalf("expected no history for the last run, got %v", ids)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	root := t.TempDir()
+
+	for _, id := range []string{"20260101T000000.000Z-a", "20260102T000000.000Z-b", "20260103T000000.000Z-c"} {
+		if err := os.MkdirAll(filepath.Join(root, "runs", id), 0o750); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+
+	if err := pruneHistory(root, 2); err != nil {
+		t.Fatalf("pruneHistory: %v", err)
+	}
+
+	ids, err := runIDs(root)
+	if err != nil || strings.Join(ids, " ") != "20260103T000000.000Z-c 20260102T000000.000Z-b" {
+		t.Fatalf("unexpected runs %v (%v)", ids, err)
+	}
+}
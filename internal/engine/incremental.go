@@ -0,0 +1,293 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// fingerprint is the state of a task's declared inputs and outputs, along
+// with the arguments it ran with and the Weavefile defining it. The
+// fingerprint of the last successful run is stored under .weave/fingerprints.
+type fingerprint struct {
+	Inputs    string `json:"inputs"`
+	Outputs   string `json:"outputs"`
+	Args      string `json:"args"`
+	Weavefile string `json:"weavefile_sha256"`
+}
+
+// incremental reports whether the task declares inputs or outputs, which
+// makes it a candidate for being skipped.
+func (o taskOptions) incremental() bool {
+	return len(o.inputs) > 0 || len(o.outputs) > 0
+}
+
+// checkFingerprint fingerprints an incremental task before it runs, and
+// reports whether it is up to date: its inputs, outputs, arguments and
+// Weavefile are those of its last successful run and every output pattern
+// matches.
+func (e *Engine) checkFingerprint(taskName string, def taskDef, run *runState) (fingerprint, bool, error) {
+	params, err := resolveParams(def.params, run.args.Params)
+	if err != nil {
+		return fingerprint{}, false, err
+	}
+
+	fp, missing, err := taskFingerprint(filepath.Dir(e.opt.File), def.taskOptions, params, run.args.Extra)
+	if err != nil {
+		return fp, false, err
+	}
+
+	// any edit to the Weavefile may change what the task does
+	if fp.Weavefile, err = hashFile(e.opt.File); err != nil {
+		return fp, false, err
+	}
+
+	if e.opt.Force || len(missing) > 0 {
+		return fp, false, nil
+	}
+
+	prev, ok := readFingerprint(stateDir(e.opt.File), taskName)
+
+	return fp, ok && prev == fp, nil
+}
+
+// recordFingerprint stores the fingerprint taken before a successful run,
+// with the outputs as the task left them.
+func (e *Engine) recordFingerprint(taskName string, def taskDef, fp fingerprint) error {
+	outputs, _, err := hashGlobs(filepath.Dir(e.opt.File), def.outputs)
+	if err != nil {
+		return err
+	}
+
+	fp.Outputs = outputs
+
+	return writeFingerprint(stateDir(e.opt.File), taskName, fp)
+}
+
+// fingerprintPath is where the fingerprint of task is stored.
+func fingerprintPath(root, task string) string {
+	return filepath.Join(root, "fingerprints", url.PathEscape(task)+".json")
+}
+
+func readFingerprint(root, task string) (fingerprint, bool) {
+	var fp fingerprint
+
+	data, err := os.ReadFile(fingerprintPath(root, task))
+	if err != nil {
+		return fp, false
+	}
+
+	return fp, json.Unmarshal(data, &fp) == nil
+}
+
+func writeFingerprint(root, task string, fp fingerprint) error {
+	if err := ensureStateDir(root, "fingerprints"); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(fp)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fingerprintPath(root, task), append(data, '\n'), 0o644)
+}
+
+// taskFingerprint computes the fingerprint of a task run with params and
+// extra, hashing the files its inputs and outputs match under dir. It also
+// returns the output patterns that matched no file.
+func taskFingerprint(dir string, opts taskOptions, params map[string]any, extra []string) (fingerprint, []string, error) {
+	var fp fingerprint
+
+	inputs, _, err := hashGlobs(dir, opts.inputs)
+	if err != nil {
+		return fp, nil, err
+	}
+
+	outputs, missing, err := hashGlobs(dir, opts.outputs)
+	if err != nil {
+		return fp, nil, err
+	}
+
+	// only the parameters the task declares can change what it does
+	h := sha256.New()
+	for _, p := range opts.params {
+		fmt.Fprintf(h, "%s=%v\x00", p.name, params[p.name])
+	}
+
+	for _, a := range extra {
+		fmt.Fprintf(h, "%s\x00", a)
+	}
+
+	fp.Inputs = inputs
+	fp.Outputs = outputs
+	fp.Args = hex.EncodeToString(h.Sum(nil))
+
+	return fp, missing, nil
+}
+
+// hashGlobs hashes the path and contents of every file under dir matched
+// by patterns, and returns the patterns that matched nothing. A pattern
+// matching a directory takes in every file below it. The state directory
+// and .git are never looked at.
+func hashGlobs(dir string, patterns []string) (string, []string, error) {
+	matched := make([]bool, len(patterns))
+	h := sha256.New()
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if rel == stateDirName || rel == ".git" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		hit := false
+
+		for i, pattern := range patterns {
+			if matchGlobOrParent(pattern, rel) {
+				matched[i] = true
+				hit = true
+			}
+		}
+
+		if !hit {
+			return nil
+		}
+
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+
+		// WalkDir visits files in lexical order, so the hash is stable
+		fmt.Fprintf(h, "%s\x00%s\n", rel, sum)
+
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	var missing []string
+
+	for i, ok := range matched {
+		if !ok {
+			missing = append(missing, patterns[i])
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), missing, nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// matchGlobOrParent matches a slash separated path, or one of the
+// directories it is in, against pattern.
+func matchGlobOrParent(pattern, name string) bool {
+	for {
+		if matchGlob(pattern, name) {
+			return true
+		}
+
+		i := strings.LastIndexByte(name, '/')
+		if i < 0 {
+			return false
+		}
+
+		name = name[:i]
+	}
+}
+
+// matchGlob matches a slash separated path against a path.Match pattern in
+// which a ** segment matches any number of directories.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := range len(parts) + 1 {
+				if matchSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(parts) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+
+		pattern, parts = pattern[1:], parts[1:]
+	}
+
+	return len(parts) == 0
+}
+
+// luaGlobList parses a list of glob patterns relative to the Weavefile
+// directory.
+func luaGlobList(key string, v lua.LValue) ([]string, error) {
+	patterns, err := luaStringList(key, v)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, raw := range patterns {
+		p := path.Clean(filepath.ToSlash(raw))
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return nil, fmt.Errorf("%s: %q must be relative to the Weavefile directory", key, raw)
+		}
+
+		for seg := range strings.SplitSeq(p, "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, fmt.Errorf("%s: %q: %w", key, raw, err)
+			}
+		}
+
+		patterns[i] = p
+	}
+
+	return patterns, nil
+}
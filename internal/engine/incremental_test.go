@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/pix-xip/weave/internal/events"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"go.mod", "go.mod", true},
+		{"go.mod", "sub/go.mod", false},
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/weave/main.go", true},
+		{"**/*.go", "cmd/weave/main.got", false},
+		{"cmd/**", "cmd/weave/main.go", true},
+		{"cmd/**/main.go", "cmd/main.go", true},
+		{"cmd/**/main.go", "internal/main.go", false},
+		{"internal/*/x_?.go", "internal/engine/x_1.go", true},
+	}
+
+	for _, tc := range cases {
+		if got := matchGlob(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+
+	if !matchGlobOrParent("dist", "dist/bin/weave") {
+		t.Errorf("expected a directory pattern to match the files below it")
+	}
+}
+
+func TestParseTaskGlobs(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	for _, src := range []string{`{ inputs = { "/etc/passwd" } }`, `{ outputs = { "../out" } }`, `{ inputs = { "[" } }`} {
+		if err := L.DoString("opts = " + src); err != nil {
+			t.Fatalf("DoString: %v", err)
+		}
+
+		if _, err := parseTaskOptions(L.GetGlobal("opts").(*lua.LTable)); err == nil {
+			t.Errorf("expected %s to be rejected", src)
+		}
+	}
+}
+
+func TestIncrementalTask(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"src/a.txt":     "a\n",
+		"src/sub/b.txt": "b\n",
+	})
+
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(fmt.Sprintf(`
+local dir = %q
+task("build", {
+  inputs = { "src/**/*.txt" },
+  outputs = { "out" },
+  params = { level = { type = "number", default = 1 } },
+}, function(ctx)
+  ctx:run("cd " .. dir .. " && cat src/a.txt src/sub/b.txt > out && echo ran >> runs.log")
+end)
+`, dir)), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true, NoHistory: true})
+	defer e.Close()
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	var upToDate bool
+	e.bus.Subscribe(func(ev events.Event) {
+		if ev.Type == events.TaskEnd {
+			upToDate, _ = ev.Fields["up_to_date"].(bool)
+		}
+	})
+
+	runs := 0
+	build := func(step string, args RunArgs, wantRun bool) {
+		t.Helper()
+
+		if err := e.Run(context.Background(), []string{"build"}, args); err != nil {
+			t.Fatalf("%s: Run: %v", step, err)
+		}
+
+		if wantRun {
+			runs++
+		}
+
+		data, _ := os.ReadFile(filepath.Join(dir, "runs.log"))
+		if got := strings.Count(string(data), "ran\n"); got != runs {
+			t.Fatalf("%s: expected %d runs, got %d", step, runs, got)
+		}
+
+		if upToDate == wantRun {
+			t.Fatalf("%s: task_end up_to_date = %v", step, upToDate)
+		}
+	}
+
+	build("first run", RunArgs{}, true)
+	build("unchanged", RunArgs{}, false)
+
+	writeTree(t, dir, map[string]string{"src/sub/b.txt": "changed\n"})
+	build("input changed", RunArgs{}, true)
+	build("unchanged again", RunArgs{}, false)
+
+	edited, err := os.ReadFile(weavefile)
+	if err != nil {
+		t.Fatalf("read Weavefile: %v", err)
+	}
+	edited = []byte(strings.Replace(string(edited), "> out &&", "> out && true &&", 1))
+	if err := os.WriteFile(weavefile, edited, 0o600); err != nil {
+		t.Fatalf("rewrite Weavefile: %v", err)
+	}
+	build("Weavefile changed", RunArgs{}, true)
+	build("Weavefile unchanged", RunArgs{}, false)
+
+	build("param changed", RunArgs{Params: map[string]string{"level": "2"}}, true)
+	build("param unchanged", RunArgs{Params: map[string]string{"level": "2"}}, false)
+
+	if err := os.Remove(filepath.Join(dir, "out")); err != nil {
+		t.Fatalf("remove output: %v", err)
+	}
+	build("output removed", RunArgs{Params: map[string]string{"level": "2"}}, true)
+
+	writeTree(t, dir, map[string]string{"out": "edited\n"})
+	build("output edited", RunArgs{Params: map[string]string{"level": "2"}}, true)
+
+	e.opt.Force = true
+	build("forced", RunArgs{Params: map[string]string{"level": "2"}}, true)
+
+	if _, err := os.Stat(filepath.Join(dir, stateDirName, ".gitignore")); err != nil {
+		t.Fatalf("expected the state directory to be ignored: %v", err)
+	}
+}
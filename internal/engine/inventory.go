@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	lua "github.com/yuin/gopher-lua"
+	"go.yaml.in/yaml/v3"
+)
+
+// inventoryTimeout bounds how long an executable inventory may run.
+var inventoryTimeout = 30 * time.Second
+
+// inventory is the decoded contents of an inventory file, with the same
+// hosts and groups layout as the config table. It is read once per run and
+// merged into the config of every task attempt.
+type inventory map[string]any
+
+// inventoryPath returns the inventory to load: override when set, otherwise
+// config.inventory resolved against dir. It is empty when there is none.
+func inventoryPath(L *lua.LState, dir, override string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+
+	tbl, ok := L.GetGlobal("config").(*lua.LTable)
+	if !ok {
+		return "", nil
+	}
+
+	switch lv := tbl.RawGetString("inventory").(type) {
+	case *lua.LNilType:
+		return "", nil
+	case lua.LString:
+		p := expandHome(string(lv))
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+
+		return p, nil
+	default:
+		return "", errors.New("config.inventory must be a string")
+	}
+}
+
+// readInventory decodes a TOML, YAML or JSON inventory file. Any other
+// executable file is run and the JSON it prints is decoded instead.
+func readInventory(path string) (inventory, error) {
+	inv, err := decodeInventory(path)
+	if err != nil {
+		return nil, fmt.Errorf("inventory %s: %w", path, err)
+	}
+
+	return inv, nil
+}
+
+func decodeInventory(path string) (inventory, error) {
+	var inv inventory
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		if _, err := toml.DecodeFile(path, &inv); err != nil {
+			return nil, err
+		}
+
+		return inv, nil
+	case ".yaml", ".yml":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return inv, yaml.Unmarshal(data, &inv)
+	case ".json":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return inv, json.Unmarshal(data, &inv)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Mode()&0o111 == 0 {
+		return nil, errors.New("unknown format, expected .toml, .yaml, .json or an executable")
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), inventoryTimeout)
+	defer cancel()
+
+	out, err := command(ctx, abs).Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("timed out after %s", inventoryTimeout)
+	}
+
+	if err != nil {
+		if ee, ok := errors.AsType[*exec.ExitError](err); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
+
+		return nil, err
+	}
+
+	return inv, json.Unmarshal(out, &inv)
+}
+
+// luaFromGo converts decoded inventory data into Lua values so it can be
+// parsed by the same code as the config table.
+func luaFromGo(L *lua.LState, v any) lua.LValue {
+	switch tv := v.(type) {
+	case nil:
+		return lua.LNil
+	case string:
+		return lua.LString(tv)
+	case bool:
+		return lua.LBool(tv)
+	case int:
+		return lua.LNumber(tv)
+	case int64:
+		return lua.LNumber(tv)
+	case uint64:
+		return lua.LNumber(tv)
+	case float64:
+		return lua.LNumber(tv)
+	case time.Time:
+		return lua.LString(tv.Format(time.RFC3339))
+	case inventory:
+		return luaFromGo(L, map[string]any(tv))
+	case map[string]any:
+		tbl := L.NewTable()
+		for k, e := range tv {
+			L.SetField(tbl, k, luaFromGo(L, e))
+		}
+
+		return tbl
+	case map[any]any:
+		tbl := L.NewTable()
+		for k, e := range tv {
+			L.SetField(tbl, fmt.Sprint(k), luaFromGo(L, e))
+		}
+
+		return tbl
+	case []any:
+		tbl := L.NewTable()
+		for _, e := range tv {
+			tbl.Append(luaFromGo(L, e))
+		}
+
+		return tbl
+	case []map[string]any:
+		tbl := L.NewTable()
+		for _, e := range tv {
+			tbl.Append(luaFromGo(L, e))
+		}
+
+		return tbl
+	default:
+		return lua.LString(fmt.Sprint(tv))
+	}
+}
+
+// goFromLua converts a Lua value into plain Go data. Tables that are
+// sequences become slices, any other table becomes a map keyed by string.
+func goFromLua(lv lua.LValue) any {
+	switch tv := lv.(type) {
+	case lua.LString:
+		return string(tv)
+	case lua.LNumber:
+		return float64(tv)
+	case lua.LBool:
+		return bool(tv)
+	case *lua.LTable:
+		if n := tv.Len(); n > 0 {
+			list := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				list = append(list, goFromLua(tv.RawGetInt(i)))
+			}
+
+			return list
+		}
+
+		m := map[string]any{}
+		tv.ForEach(func(k, v lua.LValue) {
+			m[k.String()] = goFromLua(v)
+		})
+
+		return m
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,395 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// taskOptions holds the validated options table passed to task(name, opts, fn).
+type taskOptions struct {
+	deps         []string
+	help         string
+	timeout      time.Duration // per attempt, zero means no deadline
+	retries      int           // extra attempts after the first failure
+	allowFailure bool          // failures are reported but do not stop the graph
+	params       []paramDef    // sorted by name
+	env          map[string]string
+	inputs       []string // globs relative to the Weavefile directory
+	outputs      []string // globs relative to the Weavefile directory
+}
+
+func parseTaskOptions(tbl *lua.LTable) (taskOptions, error) {
+	opts := taskOptions{}
+	if tbl == nil {
+		return opts, nil
+	}
+
+	var err error
+
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		key, ok := k.(lua.LString)
+		if !ok {
+			err = fmt.Errorf("task option keys must be strings, got %s", k.Type())
+			return
+		}
+
+		switch string(key) {
+		case "depends":
+			opts.deps, err = luaStringList(string(key), v)
+		case "help":
+			opts.help, err = luaString(string(key), v)
+		case "timeout":
+			opts.timeout, err = luaDuration(string(key), v)
+		case "retries":
+			opts.retries, err = luaNonNegativeInt(string(key), v)
+		case "allow_failure":
+			opts.allowFailure, err = luaBool(string(key), v)
+		case "params":
+			opts.params, err = parseTaskParams(v)
+		case "env":
+			opts.env, err = luaEnv(string(key), v)
+		case "inputs":
+			opts.inputs, err = luaGlobList(string(key), v)
+		case "outputs":
+			opts.outputs, err = luaGlobList(string(key), v)
+		default:
+			err = fmt.Errorf("unknown task option %q", string(key))
+		}
+	})
+
+	return opts, err
+}
+
+// opOptions holds the optional trailing options table accepted by ctx:run,
+// ctx:sync, ctx:fetch and the file primitives.
+type opOptions struct {
+	timeout time.Duration // per attempt, zero means no deadline
+	retries int           // extra attempts after the first failure
+	backoff time.Duration // wait between attempts
+	stream  bool          // echo output lines as they are produced
+	check   *bool         // raise on failure, nil follows strict mode
+	env     map[string]string
+	cwd     string
+
+	interpolate bool // fill in {{ name }} placeholders from host vars in commands and paths
+
+	// fan-out over a host group
+	parallel    int // hosts run at once, zero means all of them
+	batch       int // rolling batch size, zero means a single batch
+	maxFailures int // stop starting hosts after this many failures, zero means never
+
+	rsync rsyncOptions
+	file  fileOptions
+}
+
+// rsyncOptions are the ctx:sync and ctx:fetch specific options.
+type rsyncOptions struct {
+	delete    *bool // remove extraneous files from dst, nil uses the op default
+	exclude   []string
+	include   []string
+	gitignore bool // skip files matched by .gitignore files in src
+	checksum  bool // compare by checksum instead of size and mtime
+	bwlimit   string
+	chmod     string
+	chown     string
+	dryRun    bool // only report the changes that would be made
+	progress  bool // report transfer progress, on by default
+}
+
+// fileOptions are the options of ctx:write_file, ctx:put, ctx:get and
+// ctx:template.
+type fileOptions struct {
+	mode   *fs.FileMode // permissions to set, nil leaves them alone
+	owner  string       // "user" or "user:group"
+	engine string       // template engine, templateGo or templateInterpolate
+	dryRun bool         // only report the diff that would be applied
+}
+
+// Option keys understood by each ctx operation.
+var (
+	commonOpKeys = []string{"timeout", "retries", "backoff", "stream", "check"}
+	runOpKeys    = append(slices.Clone(commonOpKeys), "env", "cwd", "interpolate")
+	groupOpKeys  = append(slices.Clone(runOpKeys), "parallel", "batch", "max_failures")
+	rsyncOpKeys  = append(slices.Clone(commonOpKeys),
+		"delete", "exclude", "include", "gitignore", "checksum", "bwlimit", "chmod", "chown", "dry_run", "progress", "interpolate")
+	readFileOpKeys = append(slices.Clone(commonOpKeys), "interpolate")
+	fileOpKeys     = append(slices.Clone(commonOpKeys), "mode", "owner", "dry_run", "interpolate")
+	templateOpKeys = append(slices.Clone(fileOpKeys), "engine")
+)
+
+func parseOpOptions(tbl *lua.LTable, allowed []string) (opOptions, error) {
+	opts := opOptions{stream: true, interpolate: true, rsync: rsyncOptions{progress: true}, file: fileOptions{engine: templateGo}}
+	if tbl == nil {
+		return opts, nil
+	}
+
+	var err error
+
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		key, ok := k.(lua.LString)
+		if !ok {
+			err = fmt.Errorf("option keys must be strings, got %s", k.Type())
+			return
+		}
+
+		if !slices.Contains(allowed, string(key)) {
+			err = fmt.Errorf("unknown option %q", string(key))
+			return
+		}
+
+		switch string(key) {
+		case "timeout":
+			opts.timeout, err = luaDuration(string(key), v)
+		case "retries":
+			opts.retries, err = luaNonNegativeInt(string(key), v)
+		case "backoff":
+			opts.backoff, err = luaDuration(string(key), v)
+		case "stream":
+			opts.stream, err = luaBool(string(key), v)
+		case "check":
+			var check bool
+
+			check, err = luaBool(string(key), v)
+			opts.check = &check
+		case "env":
+			opts.env, err = luaEnv(string(key), v)
+		case "cwd":
+			opts.cwd, err = luaString(string(key), v)
+		case "interpolate":
+			opts.interpolate, err = luaBool(string(key), v)
+		case "parallel":
+			opts.parallel, err = luaNonNegativeInt(string(key), v)
+		case "batch":
+			opts.batch, err = luaNonNegativeInt(string(key), v)
+		case "max_failures":
+			opts.maxFailures, err = luaNonNegativeInt(string(key), v)
+		case "delete":
+			var del bool
+
+			del, err = luaBool(string(key), v)
+			opts.rsync.delete = &del
+		case "exclude":
+			opts.rsync.exclude, err = luaStringList(string(key), v)
+		case "include":
+			opts.rsync.include, err = luaStringList(string(key), v)
+		case "gitignore":
+			opts.rsync.gitignore, err = luaBool(string(key), v)
+		case "checksum":
+			opts.rsync.checksum, err = luaBool(string(key), v)
+		case "bwlimit":
+			opts.rsync.bwlimit, err = luaBandwidth(string(key), v)
+		case "chmod":
+			opts.rsync.chmod, err = luaString(string(key), v)
+		case "chown":
+			opts.rsync.chown, err = luaString(string(key), v)
+		case "dry_run":
+			opts.rsync.dryRun, err = luaBool(string(key), v)
+			opts.file.dryRun = opts.rsync.dryRun
+		case "progress":
+			opts.rsync.progress, err = luaBool(string(key), v)
+		case "mode":
+			var mode fs.FileMode
+
+			mode, err = luaFileMode(string(key), v)
+			opts.file.mode = &mode
+		case "owner":
+			opts.file.owner, err = luaOwner(string(key), v)
+		case "engine":
+			opts.file.engine, err = luaString(string(key), v)
+			if err == nil && opts.file.engine != templateGo && opts.file.engine != templateInterpolate {
+				err = fmt.Errorf("%s must be %q or %q", string(key), templateGo, templateInterpolate)
+			}
+		default:
+			err = fmt.Errorf("unknown option %q", string(key))
+		}
+	})
+
+	return opts, err
+}
+
+// luaDuration accepts either a Go duration string ("5m", "1h30m") or a
+// number of seconds.
+func luaDuration(key string, v lua.LValue) (time.Duration, error) {
+	switch lv := v.(type) {
+	case lua.LString:
+		d, err := time.ParseDuration(string(lv))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", key, err)
+		}
+
+		if d < 0 {
+			return 0, fmt.Errorf("%s must not be negative", key)
+		}
+
+		return d, nil
+	case lua.LNumber:
+		if lv < 0 {
+			return 0, fmt.Errorf("%s must not be negative", key)
+		}
+
+		return time.Duration(float64(lv) * float64(time.Second)), nil
+	default:
+		return 0, fmt.Errorf("%s must be a duration string or number of seconds", key)
+	}
+}
+
+func luaNonNegativeInt(key string, v lua.LValue) (int, error) {
+	n, ok := v.(lua.LNumber)
+	if !ok || n < 0 || float64(n) != float64(int(n)) {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+
+	return int(n), nil
+}
+
+var bandwidthRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[bBkKmMgG]?$`)
+
+// luaBandwidth accepts a number of KiB per second or an rsync size string
+// such as "500k" or "1.5m".
+func luaBandwidth(key string, v lua.LValue) (string, error) {
+	switch lv := v.(type) {
+	case lua.LNumber:
+		if lv <= 0 {
+			return "", fmt.Errorf("%s must be positive", key)
+		}
+
+		return lv.String(), nil
+	case lua.LString:
+		if !bandwidthRe.MatchString(string(lv)) {
+			return "", fmt.Errorf("%s must be a rate such as 500k or 1.5m, got %q", key, string(lv))
+		}
+
+		return string(lv), nil
+	default:
+		return "", fmt.Errorf("%s must be a number of KiB/s or a rate string", key)
+	}
+}
+
+var fileModeRe = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// luaFileMode accepts an octal permission string such as "0644". Numbers
+// are refused since Lua has no octal literals.
+func luaFileMode(key string, v lua.LValue) (fs.FileMode, error) {
+	s, ok := v.(lua.LString)
+	if !ok || !fileModeRe.MatchString(string(s)) {
+		return 0, fmt.Errorf("%s must be an octal string such as \"0644\"", key)
+	}
+
+	mode, _ := strconv.ParseUint(string(s), 8, 32)
+
+	return fs.FileMode(mode) & fs.ModePerm, nil
+}
+
+var ownerRe = regexp.MustCompile(`^[A-Za-z0-9_.][A-Za-z0-9_.-]*(:[A-Za-z0-9_.][A-Za-z0-9_.-]*)?$`)
+
+// luaOwner accepts "user" or "user:group", by name or id.
+func luaOwner(key string, v lua.LValue) (string, error) {
+	s, ok := v.(lua.LString)
+	if !ok || !ownerRe.MatchString(string(s)) {
+		return "", fmt.Errorf("%s must be \"user\" or \"user:group\"", key)
+	}
+
+	return string(s), nil
+}
+
+func luaString(key string, v lua.LValue) (string, error) {
+	s, ok := v.(lua.LString)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+
+	return string(s), nil
+}
+
+func luaBool(key string, v lua.LValue) (bool, error) {
+	b, ok := v.(lua.LBool)
+	if !ok {
+		return false, fmt.Errorf("%s must be a boolean", key)
+	}
+
+	return bool(b), nil
+}
+
+func luaStringList(key string, v lua.LValue) ([]string, error) {
+	tbl, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, errors.New(key + " must be a table of strings")
+	}
+
+	out := []string{}
+
+	tbl.ForEach(func(_, v lua.LValue) {
+		if s, ok := v.(lua.LString); ok {
+			out = append(out, string(s))
+		}
+	})
+
+	if len(out) != tbl.Len() {
+		return nil, errors.New(key + " must be a table of strings")
+	}
+
+	return out, nil
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// luaEnv parses a table of environment variables, accepting string, number
+// and boolean values.
+func luaEnv(key string, v lua.LValue) (map[string]string, error) {
+	tbl, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table", key)
+	}
+
+	env := map[string]string{}
+
+	var err error
+
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		name, ok := k.(lua.LString)
+		if !ok || !envNameRe.MatchString(string(name)) {
+			err = fmt.Errorf("%s keys must be valid variable names, got %q", key, k.String())
+			return
+		}
+
+		switch v.(type) {
+		case lua.LString, lua.LNumber, lua.LBool:
+			env[string(name)] = v.String()
+		default:
+			err = fmt.Errorf("%s.%s must be a string, number or boolean", key, string(name))
+		}
+	})
+
+	return env, err
+}
+
+// mergeEnv layers environment tables, later layers winning.
+func mergeEnv(layers ...map[string]string) map[string]string {
+	out := map[string]string{}
+
+	for _, layer := range layers {
+		maps.Copy(out, layer)
+	}
+
+	return out
+}
@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// RunArgs carries the key=value parameters and the extra arguments given
+// after "--" on the command line.
+type RunArgs struct {
+	Params map[string]string
+	Extra  []string
+}
+
+type paramType string
+
+const (
+	paramString paramType = "string"
+	paramNumber paramType = "number"
+	paramBool   paramType = "bool"
+)
+
+// paramDef is a parameter declared in a task's params option.
+type paramDef struct {
+	name     string
+	typ      paramType
+	required bool
+	def      any // typed default, nil when unset
+	help     string
+}
+
+// ParamInfo describes a declared task parameter for display.
+type ParamInfo struct {
+	Name     string
+	Type     string
+	Required bool
+	Default  string // empty when the parameter has no default
+	Help     string
+}
+
+func (p paramDef) info() ParamInfo {
+	info := ParamInfo{
+		Name:     p.name,
+		Type:     string(p.typ),
+		Required: p.required,
+		Help:     p.help,
+	}
+
+	if p.def != nil {
+		info.Default = fmt.Sprint(p.def)
+	}
+
+	return info
+}
+
+// convert parses a raw command line value into the declared type.
+func (p paramDef) convert(raw string) (any, error) {
+	switch p.typ {
+	case paramNumber:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q must be a number, got %q", p.name, raw)
+		}
+
+		return n, nil
+	case paramBool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q must be a bool, got %q", p.name, raw)
+		}
+
+		return b, nil
+	default:
+		return raw, nil
+	}
+}
+
+// parseTaskParams parses params = { name = { type=, required=, default=, help= } }.
+func parseTaskParams(v lua.LValue) ([]paramDef, error) {
+	tbl, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, errors.New("params must be a table")
+	}
+
+	var (
+		defs []paramDef
+		err  error
+	)
+
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		name, ok := k.(lua.LString)
+		if !ok || name == "" {
+			err = errors.New("params keys must be non-empty strings")
+			return
+		}
+
+		var def paramDef
+
+		def, err = parseParamDef(string(name), v)
+		defs = append(defs, def)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(defs, func(a, b paramDef) int {
+		if a.name < b.name {
+			return -1
+		}
+
+		if a.name > b.name {
+			return 1
+		}
+
+		return 0
+	})
+
+	return defs, nil
+}
+
+func parseParamDef(name string, v lua.LValue) (paramDef, error) {
+	def := paramDef{name: name, typ: paramString}
+
+	tbl, ok := v.(*lua.LTable)
+	if !ok {
+		return def, fmt.Errorf("params.%s must be a table", name)
+	}
+
+	var (
+		defVal lua.LValue = lua.LNil
+		err    error
+	)
+
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		key, ok := k.(lua.LString)
+		if !ok {
+			err = fmt.Errorf("params.%s keys must be strings", name)
+			return
+		}
+
+		switch string(key) {
+		case "type":
+			var typ string
+
+			typ, err = luaString("params."+name+".type", v)
+			def.typ = paramType(typ)
+		case "required":
+			def.required, err = luaBool("params."+name+".required", v)
+		case "default":
+			defVal = v
+		case "help":
+			def.help, err = luaString("params."+name+".help", v)
+		default:
+			err = fmt.Errorf("unknown option %q for params.%s", string(key), name)
+		}
+	})
+
+	if err != nil {
+		return def, err
+	}
+
+	switch def.typ {
+	case paramString, paramNumber, paramBool:
+	default:
+		return def, fmt.Errorf("params.%s.type must be one of string, number or bool", name)
+	}
+
+	if defVal == lua.LNil {
+		return def, nil
+	}
+
+	if def.required {
+		return def, fmt.Errorf("params.%s cannot be both required and have a default", name)
+	}
+
+	switch lv := defVal.(type) {
+	case lua.LString:
+		if def.typ == paramString {
+			def.def = string(lv)
+		}
+	case lua.LNumber:
+		if def.typ == paramNumber {
+			def.def = float64(lv)
+		}
+	case lua.LBool:
+		if def.typ == paramBool {
+			def.def = bool(lv)
+		}
+	}
+
+	if def.def == nil {
+		return def, fmt.Errorf("params.%s.default must be a %s", name, def.typ)
+	}
+
+	return def, nil
+}
+
+// resolveParams converts the raw run parameters using a task's declarations,
+// filling in defaults. Parameters the task does not declare are passed
+// through as strings.
+func resolveParams(defs []paramDef, raw map[string]string) (map[string]any, error) {
+	out := make(map[string]any, len(raw)+len(defs))
+	for k, v := range raw {
+		out[k] = v
+	}
+
+	for _, def := range defs {
+		rv, ok := raw[def.name]
+		if !ok {
+			if def.required {
+				return nil, fmt.Errorf("missing required parameter %q", def.name)
+			}
+
+			if def.def != nil {
+				out[def.name] = def.def
+			}
+
+			continue
+		}
+
+		v, err := def.convert(rv)
+		if err != nil {
+			return nil, err
+		}
+
+		out[def.name] = v
+	}
+
+	return out, nil
+}
+
+func toLuaValue(v any) lua.LValue {
+	switch tv := v.(type) {
+	case string:
+		return lua.LString(tv)
+	case float64:
+		return lua.LNumber(tv)
+	case bool:
+		return lua.LBool(tv)
+	case nil:
+		return lua.LNil
+	default:
+		return lua.LString(fmt.Sprint(tv))
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package engine
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group so cancelling the
+// command also kills anything it spawned, e.g. the remote half of ssh or
+// rsync's helper processes.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
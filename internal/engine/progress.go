@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pix-xip/weave/internal/events"
+)
+
+// rsyncProgressRe matches an rsync --info=progress2 line, e.g.
+// "  1,234,567  42%   1.20MB/s    0:00:05 (xfr#3, to-chk=10/20)".
+var rsyncProgressRe = regexp.MustCompile(
+	`^\s*([\d,]+)\s+(\d+)%\s+([\d.]+)([kMGT]?B)/s\s+(\d+):(\d{2}):(\d{2})(?:\s+\(xfr#(\d+),\s+\w+-chk=(\d+)/(\d+)\))?\s*$`)
+
+// rsyncVersionRe matches the version in the first line of rsync --version,
+// e.g. "rsync  version v3.2.7  protocol version 31". openrsync reports the
+// rsync version it is compatible with the same way.
+var rsyncVersionRe = regexp.MustCompile(`rsync\s+version\s+v?(\d+)\.(\d+)`)
+
+// rsyncSupport finds out once per run whether the local rsync understands
+// --info=progress2, which arrived in rsync 3.1.
+type rsyncSupport struct {
+	once     sync.Once
+	progress bool
+}
+
+// hasProgress reports whether rsync can report transfer progress. A nil
+// rsyncSupport asks rsync every time.
+func (s *rsyncSupport) hasProgress(ctx context.Context) bool {
+	if s == nil {
+		return rsyncHasProgress(ctx)
+	}
+
+	s.once.Do(func() {
+		s.progress = rsyncHasProgress(ctx)
+	})
+
+	return s.progress
+}
+
+func rsyncHasProgress(ctx context.Context) bool {
+	out, err := exec.CommandContext(ctx, "rsync", "--version").Output()
+	if err != nil {
+		return false
+	}
+
+	return rsyncVersionHasProgress(string(out))
+}
+
+// rsyncVersionHasProgress reports whether the rsync --version output is
+// that of rsync 3.1 or newer.
+func rsyncVersionHasProgress(version string) bool {
+	m := rsyncVersionRe.FindStringSubmatch(version)
+	if m == nil {
+		return false
+	}
+
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+
+	return major > 3 || major == 3 && minor >= 1
+}
+
+// transferProgress is one parsed rsync progress update.
+type transferProgress struct {
+	bytes       int64
+	percent     int
+	rate        float64 // bytes per second
+	eta         time.Duration
+	transferred int // files transferred so far
+	toCheck     int // files still to be checked
+	total       int // files known about so far
+}
+
+func parseRsyncProgress(line string) (transferProgress, bool) {
+	m := rsyncProgressRe.FindStringSubmatch(line)
+	if m == nil {
+		return transferProgress{}, false
+	}
+
+	var p transferProgress
+
+	p.bytes, _ = strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+	p.percent, _ = strconv.Atoi(m[2])
+
+	rate, _ := strconv.ParseFloat(m[3], 64)
+	p.rate = rate * float64(unitBytes(m[4]))
+
+	h, _ := strconv.Atoi(m[5])
+	mins, _ := strconv.Atoi(m[6])
+	secs, _ := strconv.Atoi(m[7])
+	p.eta = time.Duration(h)*time.Hour + time.Duration(mins)*time.Minute + time.Duration(secs)*time.Second
+
+	if m[8] != "" {
+		p.transferred, _ = strconv.Atoi(m[8])
+		p.toCheck, _ = strconv.Atoi(m[9])
+		p.total, _ = strconv.Atoi(m[10])
+	}
+
+	return p, true
+}
+
+// unitBytes converts rsync's rate units, which are powers of 1024.
+func unitBytes(unit string) int64 {
+	switch unit {
+	case "kB":
+		return 1 << 10
+	case "MB":
+		return 1 << 20
+	case "GB":
+		return 1 << 30
+	case "TB":
+		return 1 << 40
+	default:
+		return 1
+	}
+}
+
+// progressWriter splits rsync's stdout on carriage returns as well as
+// newlines, turning progress updates into calls to onProgress and passing
+// every other line through to out.
+type progressWriter struct {
+	mu         sync.Mutex
+	buf        []byte
+	out        io.Writer
+	onProgress func(transferProgress)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+
+		if err := w.line(string(w.buf[:i])); err != nil {
+			return len(p), err
+		}
+
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush handles any buffered partial line.
+func (w *progressWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err := w.line(string(w.buf))
+	w.buf = nil
+
+	return err
+}
+
+func (w *progressWriter) line(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	if p, ok := parseRsyncProgress(line); ok {
+		w.onProgress(p)
+		return nil
+	}
+
+	_, err := io.WriteString(w.out, line+"\n")
+
+	return err
+}
+
+// withRsyncProgress wraps an rsync attempt run with --info=progress2 so its
+// progress is published as events.Progress instead of being captured as
+// output.
+func (c *Ctx) withRsyncProgress(attempt attemptFunc, opID, op, src, dst string) attemptFunc {
+	return func(ctx context.Context, stdout, stderr io.Writer) error {
+		pw := &progressWriter{
+			out: stdout,
+			onProgress: func(p transferProgress) {
+				c.emit(events.Progress, opID, map[string]any{
+					"op":             op,
+					"src":            src,
+					"dst":            dst,
+					"bytes":          p.bytes,
+					"percent":        p.percent,
+					"bytes_per_sec":  int64(p.rate),
+					"eta_ms":         p.eta.Milliseconds(),
+					"files_done":     p.transferred,
+					"files_to_check": p.toCheck,
+					"files_total":    p.total,
+				})
+			},
+		}
+
+		err := attempt(ctx, pw, stderr)
+		if ferr := pw.Flush(); err == nil {
+			err = ferr
+		}
+
+		return err
+	}
+}
+
+// humanBytes formats n with a binary unit, e.g. "1.5MiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRsyncProgress(t *testing.T) {
+	p, ok := parseRsyncProgress("    524,288,000  42%    1.50MB/s    0:01:05 (xfr#3, to-chk=10/20)")
+	if !ok {
+		t.Fatal("expected a progress line")
+	}
+
+	want := transferProgress{
+		bytes:       524288000,
+		percent:     42,
+		rate:        1.5 * (1 << 20),
+		eta:         65 * time.Second,
+		transferred: 3,
+		toCheck:     10,
+		total:       20,
+	}
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+
+	if p, ok := parseRsyncProgress("         32,768   0%    0.00kB/s    0:00:00"); !ok || p.bytes != 32768 {
+		t.Fatalf("unexpected short progress %+v %v", p, ok)
+	}
+
+	for _, line := range []string{"sending incremental file list", ">f+++++++++ app.js", ""} {
+		if _, ok := parseRsyncProgress(line); ok {
+			t.Fatalf("%q is not a progress line", line)
+		}
+	}
+}
+
+func TestRsyncVersionHasProgress(t *testing.T) {
+	cases := map[string]bool{
+		"rsync  version 3.2.7  protocol version 31\n":                      true,
+		"rsync  version v3.4.1  protocol version 32\n":                     true,
+		"rsync  version 3.1.0  protocol version 31\n":                      true,
+		"rsync  version 3.0.9  protocol version 30\n":                      false,
+		"rsync  version 2.6.9  protocol version 29\n":                      false,
+		"openrsync: protocol version 29\nrsync version 2.6.9 compatible\n": false,
+		"": false,
+	}
+
+	for out, want := range cases {
+		if got := rsyncVersionHasProgress(out); got != want {
+			t.Errorf("rsyncVersionHasProgress(%q) = %v, want %v", out, got, want)
+		}
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var (
+		out     strings.Builder
+		updates []int
+	)
+
+	w := &progressWriter{out: &out, onProgress: func(p transferProgress) { updates = append(updates, p.percent) }}
+
+	chunks := []string{
+		"sending incremental file list\n",
+		"          1,024  50%    1.00MB/s    0:00:01\r     2,0",
+		"48 100%    2.00MB/s    0:00:00 (xfr#1, to-chk=0/1)\n",
+		"\nsent 2,150 bytes",
+	}
+	for _, c := range chunks {
+		if _, err := w.Write([]byte(c)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if got := out.String(); got != "sending incremental file list\nsent 2,150 bytes\n" {
+		t.Fatalf("unexpected passthrough %q", got)
+	}
+
+	if len(updates) != 2 || updates[0] != 50 || updates[1] != 100 {
+		t.Fatalf("unexpected progress updates %v", updates)
+	}
+
+	if got := progressLine(map[string]any{
+		"percent": 50, "bytes": int64(3 << 20), "bytes_per_sec": int64(1 << 20), "eta_ms": int64(3000),
+	}); got != "[============            ]  50% 3.0MiB 1.0MiB/s ETA 3s" {
+		t.Fatalf("unexpected progress line %q", got)
+	}
+}
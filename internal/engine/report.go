@@ -0,0 +1,346 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pix-xip/weave/internal/events"
+)
+
+// runReport summarises a run from its events, per task.
+type runReport struct {
+	RunID    string       `json:"run_id"`
+	Start    time.Time    `json:"start"`
+	Duration int64        `json:"duration_ms"`
+	OK       bool         `json:"ok"`
+	Tasks    []taskReport `json:"tasks"`
+
+	mu      sync.Mutex
+	byName  map[string]*taskReport
+	started []string             // tasks in the order they started
+	ops     map[string]opSummary // op_start details by op ID
+}
+
+// taskReport is the outcome of a single task.
+type taskReport struct {
+	Name      string     `json:"name"`
+	Status    TaskStatus `json:"status"`
+	Duration  int64      `json:"duration_ms"`
+	Attempts  int        `json:"attempts"`
+	Ops       int        `json:"ops"`
+	Error     string     `json:"error,omitempty"`
+	FailedOps []failedOp `json:"failed_ops,omitempty"`
+}
+
+// failedOp is an op that finished with ok = false.
+type failedOp struct {
+	Op      string `json:"op"`
+	Host    string `json:"host,omitempty"`
+	Command string `json:"command"`
+	Code    int    `json:"code"`
+}
+
+// opSummary is what is kept of an op_start until its op_end arrives.
+type opSummary struct {
+	op, host, command string
+}
+
+func newRunReport(runID string, start time.Time) *runReport {
+	return &runReport{
+		RunID:  runID,
+		Start:  start,
+		byName: map[string]*taskReport{},
+		ops:    map[string]opSummary{},
+	}
+}
+
+// Handle aggregates the events of the report's run, it is a Handler for
+// Bus.Subscribe.
+func (r *runReport) Handle(ev events.Event) {
+	if ev.RunID != r.RunID {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch ev.Type {
+	case events.TaskStart:
+		r.task(ev.Task)
+	case events.TaskEnd:
+		t := r.task(ev.Task)
+		t.Attempts, _ = ev.Fields["attempts"].(int)
+		t.Error = strField(ev.Fields, "error")
+
+		t.Duration, _ = ev.Fields["duration_ms"].(int64)
+	case events.OpStart:
+		command := strField(ev.Fields, "cmd")
+		if command == "" {
+			command = strField(ev.Fields, "src") + " -> " + strField(ev.Fields, "dst")
+		}
+
+		if p := strField(ev.Fields, "path"); p != "" {
+			command = p
+		}
+
+		r.ops[ev.OpID] = opSummary{op: strField(ev.Fields, "op"), host: strField(ev.Fields, "host"), command: command}
+	case events.OpEnd:
+		t := r.task(ev.Task)
+		t.Ops++
+
+		op := r.ops[ev.OpID]
+		delete(r.ops, ev.OpID)
+
+		if ok, _ := ev.Fields["ok"].(bool); !ok {
+			code, _ := ev.Fields["code"].(int)
+			t.FailedOps = append(t.FailedOps, failedOp{Op: op.op, Host: op.host, Command: op.command, Code: code})
+		}
+	}
+}
+
+func (r *runReport) task(name string) *taskReport {
+	t, ok := r.byName[name]
+	if !ok {
+		t = &taskReport{Name: name}
+		r.byName[name] = t
+		r.started = append(r.started, name)
+	}
+
+	return t
+}
+
+// finish fills in the final status of every task in result. Tasks appear
+// in the order they started, followed by those that never did.
+func (r *runReport) finish(result GraphResult, end time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Duration = end.Sub(r.Start).Milliseconds()
+	r.OK = true
+	r.Tasks = r.Tasks[:0]
+
+	order := slices.Clone(r.started)
+	for _, name := range slices.Sorted(maps.Keys(result)) {
+		if !slices.Contains(order, string(name)) {
+			order = append(order, string(name))
+		}
+	}
+
+	for _, name := range order {
+		status, ok := result[TaskName(name)]
+		if !ok {
+			continue
+		}
+
+		t := r.task(name)
+		t.Status = status
+		r.Tasks = append(r.Tasks, *t)
+
+		if status == StatusFailed || status == StatusCancelled {
+			r.OK = false
+		}
+	}
+}
+
+// writeText writes the report as a table.
+func (r *runReport) writeText(w io.Writer) error {
+	var buf bytes.Buffer
+
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "TASK\tSTATUS\tDURATION\tOPS\tFAILED")
+
+	for _, t := range r.Tasks {
+		failed := make([]string, 0, len(t.FailedOps))
+		for _, op := range t.FailedOps {
+			failed = append(failed, op.String())
+		}
+
+		if len(failed) == 0 {
+			failed = append(failed, "")
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", t.Name, t.Status, formatDuration(t.Duration), t.Ops, failed[0])
+
+		for _, f := range failed[1:] {
+			fmt.Fprintf(tw, "\t\t\t\t%s\n", f)
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// rows without failures are padded up to the last column
+	for line := range strings.Lines(buf.String()) {
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (op failedOp) String() string {
+	name := op.Op
+	if op.Host != "" {
+		name += "@" + op.Host
+	}
+
+	return fmt.Sprintf("%s (exit %d): %s", name, op.Code, op.Command)
+}
+
+func formatDuration(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).String()
+}
+
+// JUnit XML layout, as understood by most CI systems.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	ID        string      `xml:"id,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func junitSeconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
+
+// writeJUnit writes the report as JUnit XML, with a test case per task.
+// Failed tasks are failures, cancelled ones errors and skipped ones
+// skipped. An allowed failure passes, with its error kept in system-err.
+func (r *runReport) writeJUnit(w io.Writer) error {
+	suite := junitSuite{
+		Name:      "weave",
+		ID:        r.RunID,
+		Timestamp: r.Start.UTC().Format(time.RFC3339),
+		Tests:     len(r.Tasks),
+		Time:      junitSeconds(r.Duration),
+	}
+
+	for _, t := range r.Tasks {
+		tc := junitCase{Name: t.Name, Classname: "weave", Time: junitSeconds(t.Duration)}
+
+		details := make([]string, 0, len(t.FailedOps))
+		for _, op := range t.FailedOps {
+			details = append(details, op.String())
+		}
+
+		switch t.Status {
+		case StatusFailed:
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: t.Error, Body: strings.Join(details, "\n")}
+		case StatusCancelled:
+			suite.Errors++
+			tc.Error = &junitMessage{Message: "cancelled", Body: t.Error}
+		case StatusSkipped:
+			suite.Skipped++
+			tc.Skipped = &junitMessage{Message: "a dependency failed"}
+		case StatusAllowedFailure:
+			tc.SystemErr = strings.Join(append([]string{t.Error}, details...), "\n")
+		}
+
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	doc := junitSuites{
+		Name:     "weave",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
+
+// checkReportPath rejects a --report path whose format is unknown.
+func checkReportPath(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".xml":
+		return nil
+	default:
+		return fmt.Errorf("report %s: unknown format, expected .json or .xml (JUnit)", path)
+	}
+}
+
+// writeReport writes the report to path, as JSON or JUnit XML depending on
+// its extension.
+func (r *runReport) writeReport(path string) error {
+	if err := checkReportPath(path); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".xml") {
+		err = r.writeJUnit(f)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	}
+
+	return errors.Join(err, f.Close())
+}
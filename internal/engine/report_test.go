@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/pix-xip/weave/internal/events"
+)
+
+func testReport() *runReport {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := newRunReport("r1", start)
+
+	for _, ev := range []events.Event{
+		{Type: events.TaskStart, Task: "build"},
+		{Type: events.OpStart, Task: "build", OpID: "1", Fields: map[string]any{"op": "run", "cmd": "go build"}},
+		{Type: events.OpEnd, Task: "build", OpID: "1", Fields: map[string]any{"ok": true, "code": 0}},
+		{Type: events.TaskEnd, Task: "build", Fields: map[string]any{"attempts": 1, "duration_ms": int64(1500)}},
+		{Type: events.TaskStart, Task: "deploy"},
+		{Type: events.OpStart, Task: "deploy", OpID: "2", Fields: map[string]any{"op": "run", "host": "web", "cmd": "make deploy"}},
+		{Type: events.OpEnd, Task: "deploy", OpID: "2", Fields: map[string]any{"ok": false, "code": 2}},
+		{Type: events.TaskEnd, Task: "deploy", Fields: map[string]any{"attempts": 1, "duration_ms": int64(250), "error": "boom"}},
+		{Type: events.TaskStart, Task: "other", RunID: "r2"},
+	} {
+		if ev.RunID == "" {
+			ev.RunID = "r1"
+		}
+
+		r.Handle(ev)
+	}
+
+	r.finish(GraphResult{"build": StatusSucceeded, "deploy": StatusFailed, "notify": StatusSkipped}, start.Add(2*time.Second))
+
+	return r
+}
+
+func TestRunReportText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().writeText(&buf); err != nil {
+		t.Fatalf("writeText: %v", err)
+	}
+
+	want := `TASK    STATUS     DURATION  OPS  FAILED
+build   succeeded  1.5s      1
+deploy  failed     250ms     1    run@web (exit 2): make deploy
+notify  skipped    0s        0
+`
+	if buf.String() != want {
+		t.Fatalf("unexpected table:\n%s", buf.String())
+	}
+}
+
+func TestRunReportJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().writeJUnit(&buf); err != nil {
+		t.Fatalf("writeJUnit: %v", err)
+	}
+
+	for _, want := range []string{
+		`<testsuites name="weave" tests="3" failures="1" errors="0" skipped="1" time="2.000">`,
+		`<testsuite name="weave" id="r1" timestamp="2026-01-02T03:04:05Z" tests="3" failures="1" errors="0" skipped="1" time="2.000">`,
+		`<testcase name="build" classname="weave" time="1.500"></testcase>`,
+		`<failure message="boom">run@web (exit 2): make deploy</failure>`,
+		`<skipped message="a dependency failed"></skipped>`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %s in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRunWritesReports(t *testing.T) {
+	dir := t.TempDir()
+	weavefile := filepath.Join(dir, "Weavefile.lua")
+	if err := os.WriteFile(weavefile, []byte(`
+task("ok", function(ctx) ctx:run("true") end)
+task("bad", { depends = { "ok" } }, function(ctx) ctx:run("exit 3", { check = true }) end)
+`), 0o600); err != nil {
+		t.Fatalf("write Weavefile: %v", err)
+	}
+
+	jsonPath := filepath.Join(dir, "report.json")
+	xmlPath := filepath.Join(dir, "junit.xml")
+
+	e := New(Options{File: weavefile, LogFormat: log.TextFormatter, Quiet: true, Reports: []string{jsonPath, xmlPath}})
+	defer e.Close()
+
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := e.Run(context.Background(), []string{"bad"}, RunArgs{}); err == nil {
+		t.Fatalf("expected the run to fail")
+	}
+
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatalf("read report: %v", err)
+	}
+
+	var report struct {
+		OK    bool `json:"ok"`
+		Tasks []struct {
+			Name      string     `json:"name"`
+			Status    string     `json:"status"`
+			Ops       int        `json:"ops"`
+			FailedOps []failedOp `json:"failed_ops"`
+		} `json:"tasks"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+
+	if report.OK || len(report.Tasks) != 2 || report.Tasks[0].Name != "ok" || report.Tasks[1].Status != "failed" ||
+		len(report.Tasks[1].FailedOps) != 1 || report.Tasks[1].FailedOps[0].Command != "exit 3" || report.Tasks[1].FailedOps[0].Code != 3 {
+		t.Fatalf("unexpected report %s", data)
+	}
+
+	if _, err := os.Stat(xmlPath); err != nil {
+		t.Fatalf("expected a JUnit report: %v", err)
+	}
+
+	e.opt.Reports = []string{filepath.Join(dir, "report.txt")}
+	if err := e.Run(context.Background(), []string{"ok"}, RunArgs{}); err == nil || !strings.Contains(err.Error(), "unknown format") {
+		t.Fatalf("expected an unknown format error, got %v", err)
+	}
+}
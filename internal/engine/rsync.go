@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// rsyncFlags builds the rsync flags for op ("sync" or "fetch") from the call
+// options. Only sync deletes extraneous files unless delete says otherwise.
+func rsyncFlags(op string, o rsyncOptions) []string {
+	args := []string{"-az"}
+
+	del := op == "sync"
+	if o.delete != nil {
+		del = *o.delete
+	}
+
+	if del {
+		args = append(args, "--delete")
+	}
+
+	if o.checksum {
+		args = append(args, "--checksum")
+	}
+
+	if o.bwlimit != "" {
+		args = append(args, "--bwlimit="+o.bwlimit)
+	}
+
+	if o.chmod != "" {
+		args = append(args, "--chmod="+o.chmod)
+	}
+
+	if o.chown != "" {
+		args = append(args, "--chown="+o.chown)
+	}
+
+	// rsync uses the first matching rule, so includes go ahead of excludes
+	for _, p := range o.include {
+		args = append(args, "--include="+p)
+	}
+
+	for _, p := range o.exclude {
+		args = append(args, "--exclude="+p)
+	}
+
+	if o.gitignore {
+		args = append(args, "--filter=:- .gitignore")
+	}
+
+	if o.dryRun {
+		args = append(args, "--dry-run", "--itemize-changes")
+	} else if o.progress {
+		args = append(args, "--info=progress2")
+	}
+
+	return args
+}
+
+// rsyncChange is one line of rsync's --itemize-changes output.
+type rsyncChange struct {
+	path   string
+	action string // "create", "update", "attrs" or "delete"
+	kind   string // "file", "dir", "symlink", "device" or "special"
+	flags  string // the raw YXcstpoguax code, empty for deletions
+}
+
+// parseItemizedChanges reads the changes rsync reported with
+// --itemize-changes, ignoring any other output.
+func parseItemizedChanges(out string) []rsyncChange {
+	changes := []rsyncChange{}
+
+	for line := range strings.Lines(out) {
+		line = strings.TrimRight(line, "\r\n")
+
+		if rest, ok := strings.CutPrefix(line, "*deleting"); ok {
+			p := strings.TrimSpace(rest)
+
+			kind := "file"
+			if strings.HasSuffix(p, "/") {
+				kind = "dir"
+			}
+
+			changes = append(changes, rsyncChange{path: p, action: "delete", kind: kind})
+
+			continue
+		}
+
+		if len(line) < 13 || line[11] != ' ' || !strings.ContainsRune("<>ch.", rune(line[0])) {
+			continue
+		}
+
+		flags, p := line[:11], line[12:]
+
+		kind := map[byte]string{'f': "file", 'd': "dir", 'L': "symlink", 'D': "device", 'S': "special"}[flags[1]]
+		if kind == "" {
+			continue
+		}
+
+		if kind == "symlink" {
+			p, _, _ = strings.Cut(p, " -> ")
+		}
+
+		action := "update"
+
+		switch {
+		case strings.Trim(flags[2:], "+") == "":
+			action = "create"
+		case flags[0] == '.':
+			action = "attrs"
+		}
+
+		changes = append(changes, rsyncChange{path: p, action: action, kind: kind, flags: flags})
+	}
+
+	return changes
+}
+
+func rsyncChangesTable(L *lua.LState, changes []rsyncChange) *lua.LTable {
+	tbl := L.NewTable()
+
+	for _, ch := range changes {
+		entry := L.NewTable()
+		L.SetField(entry, "path", lua.LString(ch.path))
+		L.SetField(entry, "action", lua.LString(ch.action))
+		L.SetField(entry, "kind", lua.LString(ch.kind))
+		L.SetField(entry, "flags", lua.LString(ch.flags))
+		tbl.Append(entry)
+	}
+
+	return tbl
+}
@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRsyncFlags(t *testing.T) {
+	keep := false
+
+	for _, tc := range []struct {
+		op   string
+		opts rsyncOptions
+		want string
+	}{
+		{"sync", rsyncOptions{}, "-az --delete"},
+		{"fetch", rsyncOptions{}, "-az"},
+		{"sync", rsyncOptions{delete: &keep}, "-az"},
+		{
+			"sync",
+			rsyncOptions{
+				checksum:  true,
+				bwlimit:   "1.5m",
+				chmod:     "D755,F644",
+				chown:     "app:app",
+				include:   []string{"dist/keep.log"},
+				exclude:   []string{"*.log", "node_modules/"},
+				gitignore: true,
+				dryRun:    true,
+			},
+			"-az --delete --checksum --bwlimit=1.5m --chmod=D755,F644 --chown=app:app " +
+				"--include=dist/keep.log --exclude=*.log --exclude=node_modules/ " +
+				"--filter=:- .gitignore --dry-run --itemize-changes",
+		},
+	} {
+		if got := strings.Join(rsyncFlags(tc.op, tc.opts), " "); got != tc.want {
+			t.Fatalf("%s %+v:\ngot  %s\nwant %s", tc.op, tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestParseItemizedChanges(t *testing.T) {
+	out := `sending incremental file list
+.d..t...... ./
+>f+++++++++ new.txt
+>f.st...... changed.txt
+cd+++++++++ sub/
+cL+++++++++ link -> new.txt
+*deleting   old.txt
+*deleting   olddir/
+
+sent 123 bytes  received 45 bytes
+`
+
+	want := []rsyncChange{
+		{path: "./", action: "attrs", kind: "dir", flags: ".d..t......"},
+		{path: "new.txt", action: "create", kind: "file", flags: ">f+++++++++"},
+		{path: "changed.txt", action: "update", kind: "file", flags: ">f.st......"},
+		{path: "sub/", action: "create", kind: "dir", flags: "cd+++++++++"},
+		{path: "link", action: "create", kind: "symlink", flags: "cL+++++++++"},
+		{path: "old.txt", action: "delete", kind: "file"},
+		{path: "olddir/", action: "delete", kind: "dir"},
+	}
+
+	if got := parseItemizedChanges(out); !reflect.DeepEqual(got, want) {
+		t.Fatalf("changes mismatch:\ngot  %+v\nwant %+v", got, want)
+	}
+}
@@ -1,23 +1,94 @@
 package engine
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"slices"
 	"strings"
-	"sync"
 )
 
 type TaskName string
 
 type Runner interface {
-	Run(name TaskName) error
+	Run(ctx context.Context, name TaskName) error
 }
 
-func RunGraphParallel(r Runner, deps map[TaskName][]TaskName, maxWorkers int) error {
+// FailureMode controls how RunGraphParallel reacts to a failing task.
+type FailureMode int
+
+const (
+	// FailStop stops scheduling new tasks and lets running tasks finish.
+	FailStop FailureMode = iota
+	// FailFast stops scheduling and cancels tasks that are still running.
+	FailFast
+	// KeepGoing runs every task whose dependencies succeeded.
+	KeepGoing
+)
+
+// ErrAllowedFailure is wrapped by a Runner to report a failure that must not
+// stop the graph: dependents still run and RunGraphParallel returns no error
+// for it.
+var ErrAllowedFailure = errors.New("allowed failure")
+
+// ErrUpToDate is returned by a Runner for a task it skipped because there
+// was nothing to do. It counts as a success.
+var ErrUpToDate = errors.New("up to date")
+
+type TaskStatus string
+
+const (
+	StatusSucceeded      TaskStatus = "succeeded"
+	StatusAllowedFailure TaskStatus = "allowed_failure"
+	StatusUpToDate       TaskStatus = "up_to_date"
+	StatusFailed         TaskStatus = "failed"
+	StatusSkipped        TaskStatus = "skipped"
+	StatusCancelled      TaskStatus = "cancelled"
+)
+
+type GraphOptions struct {
+	MaxWorkers int
+	Mode       FailureMode
+}
+
+// GraphResult records the final status of every task in a graph run.
+type GraphResult map[TaskName]TaskStatus
+
+// Tasks returns the tasks that finished with status, sorted by name.
+func (g GraphResult) Tasks(status TaskStatus) []TaskName {
+	out := []TaskName{}
+
+	for t, s := range g {
+		if s == status {
+			out = append(out, t)
+		}
+	}
+
+	slices.Sort(out)
+
+	return out
+}
+
+// RunGraphParallel runs every task in deps once its dependencies have
+// completed, bounded by opts.MaxWorkers. What happens after a task fails is
+// decided by opts.Mode; cancelling ctx always stops scheduling and cancels
+// the context handed to tasks that are still running.
+//
+// In KeepGoing mode the returned error joins every task failure, otherwise
+// it is the first failure seen.
+func RunGraphParallel(ctx context.Context, r Runner, deps map[TaskName][]TaskName, opts GraphOptions) (GraphResult, error) {
+	maxWorkers := opts.MaxWorkers
 	if maxWorkers <= 0 {
 		maxWorkers = 1
 	}
 
+	if cycle := detectCycle(deps); len(cycle) > 0 {
+		return nil, errors.New("cycle: " + strings.Join(cycle, " -> "))
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	depsCount := map[TaskName]int{}
 	dependents := map[TaskName][]TaskName{}
 	all := map[TaskName]struct{}{}
@@ -49,80 +120,102 @@ func RunGraphParallel(r Runner, deps map[TaskName][]TaskName, maxWorkers int) er
 		}
 	}
 
-	slices.Sort(ready)
-
-	processed := 0
-
-	for len(ready) > 0 {
-		batch := ready
-		ready = nil
+	type result struct {
+		task TaskName
+		err  error
+	}
 
-		if err := runBatch(r, batch, maxWorkers); err != nil {
-			return err
-		}
+	// Tasks are dispatched the moment their own dependencies complete rather
+	// than in waves, ready tasks are started in name order so runs stay
+	// deterministic for a given graph and worker count.
+	results := make(chan result)
+	status := GraphResult{}
+	running := 0
 
-		processed += len(batch)
-		for _, t := range batch {
-			for _, dep := range dependents[t] {
-				depsCount[dep]--
-				if depsCount[dep] == 0 {
-					ready = append(ready, dep)
-				}
-			}
-		}
+	var errs []error
 
+	for {
 		slices.Sort(ready)
-	}
-
-	if processed != len(all) {
-		if cycle := detectCycle(deps); len(cycle) > 0 {
-			return errors.New("cycle: " + strings.Join(cycle, " -> "))
-		}
 
-		return errors.New("dependency cycle detected")
-	}
-
-	return nil
-}
+		for (len(errs) == 0 || opts.Mode == KeepGoing) && runCtx.Err() == nil &&
+			running < maxWorkers && len(ready) > 0 {
+			t := ready[0]
+			ready = ready[1:]
+			running++
 
-func runBatch(r Runner, batch []TaskName, maxWorkers int) error {
-	if len(batch) == 0 {
-		return nil
-	}
+			go func(task TaskName) {
+				results <- result{task: task, err: r.Run(runCtx, task)}
+			}(t)
+		}
 
-	sem := make(chan struct{}, maxWorkers)
+		if running == 0 {
+			break
+		}
 
-	var (
-		wg       sync.WaitGroup
-		mu       sync.Mutex
-		firstErr error
-	)
+		res := <-results
+		running--
+
+		switch {
+		case res.err == nil:
+			status[res.task] = StatusSucceeded
+		case errors.Is(res.err, ErrUpToDate):
+			status[res.task] = StatusUpToDate
+		case errors.Is(res.err, ErrAllowedFailure):
+			status[res.task] = StatusAllowedFailure
+		default:
+			if runCtx.Err() != nil && isContextErr(res.err) {
+				status[res.task] = StatusCancelled
+				continue
+			}
 
-	for _, t := range batch {
-		wg.Add(1)
+			status[res.task] = StatusFailed
+			errs = append(errs, fmt.Errorf("task %q: %w", res.task, res.err))
 
-		go func(task TaskName) {
-			defer wg.Done()
+			if opts.Mode == FailFast {
+				cancel()
+			}
 
-			sem <- struct{}{}
+			continue
+		}
 
-			defer func() { <-sem }()
+		for _, dep := range dependents[res.task] {
+			depsCount[dep]--
+			if depsCount[dep] == 0 {
+				ready = append(ready, dep)
+			}
+		}
+	}
 
-			if err := r.Run(task); err != nil {
-				mu.Lock()
+	// anything left never started, either because a dependency did not
+	// succeed or because the run stopped early
+	for t := range all {
+		if _, ok := status[t]; ok {
+			continue
+		}
 
-				if firstErr == nil {
-					firstErr = err
-				}
+		if ctx.Err() != nil {
+			status[t] = StatusCancelled
+		} else {
+			status[t] = StatusSkipped
+		}
+	}
 
-				mu.Unlock()
-			}
-		}(t)
+	if err := ctx.Err(); err != nil {
+		return status, err
 	}
 
-	wg.Wait()
+	switch {
+	case len(errs) == 0:
+		return status, nil
+	case opts.Mode == KeepGoing:
+		return status, errors.Join(errs...)
+	default:
+		return status, errs[0]
+	}
+}
 
-	return firstErr
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
 }
 
 func detectCycle(deps map[TaskName][]TaskName) []string {
@@ -1,11 +1,14 @@
 package engine
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type recordRunner struct {
@@ -14,7 +17,7 @@ type recordRunner struct {
 	errs  map[TaskName]error
 }
 
-func (r *recordRunner) Run(name TaskName) error {
+func (r *recordRunner) Run(_ context.Context, name TaskName) error {
 	r.mu.Lock()
 	r.order = append(r.order, name)
 	err := r.errs[name]
@@ -29,7 +32,7 @@ func TestRunGraphParallelLinear(t *testing.T) {
 		"a": {},
 	}
 	r := &recordRunner{}
-	if err := RunGraphParallel(r, deps, 2); err != nil {
+	if _, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2}); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	want := []TaskName{"a", "b", "c"}
@@ -45,7 +48,7 @@ func TestRunGraphParallelFanOutStable(t *testing.T) {
 		"sync":  {},
 	}
 	r := &recordRunner{}
-	if err := RunGraphParallel(r, deps, 2); err != nil {
+	if _, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2}); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if len(r.order) != 3 {
@@ -67,7 +70,7 @@ func TestRunGraphParallelCycle(t *testing.T) {
 		"release": {"build"},
 	}
 	r := &recordRunner{}
-	err := RunGraphParallel(r, deps, 2)
+	_, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2})
 	if err == nil {
 		t.Fatalf("expected error")
 	}
@@ -82,7 +85,7 @@ func TestRunGraphParallelStopsOnError(t *testing.T) {
 		"a": {},
 	}
 	r := &recordRunner{errs: map[TaskName]error{"a": errors.New("fail")}}
-	err := RunGraphParallel(r, deps, 2)
+	_, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2})
 	if err == nil {
 		t.Fatalf("expected error")
 	}
@@ -94,6 +97,212 @@ func TestRunGraphParallelStopsOnError(t *testing.T) {
 	}
 }
 
+type blockingRunner struct {
+	recordRunner
+	release chan struct{}
+	blocked TaskName
+	waitFor TaskName
+}
+
+func (r *blockingRunner) Run(ctx context.Context, name TaskName) error {
+	if name == r.blocked {
+		select {
+		case <-r.release:
+		case <-time.After(2 * time.Second):
+			return errors.New("timed out waiting for " + string(r.waitFor))
+		}
+	}
+
+	err := r.recordRunner.Run(ctx, name)
+	if name == r.waitFor {
+		close(r.release)
+	}
+
+	return err
+}
+
+func TestRunGraphParallelNoWaveBarrier(t *testing.T) {
+	deps := map[TaskName][]TaskName{
+		"slow":  {},
+		"fast":  {},
+		"after": {"fast"},
+	}
+	r := &blockingRunner{
+		release: make(chan struct{}),
+		blocked: "slow",
+		waitFor: "after",
+	}
+	if _, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []TaskName{"fast", "after", "slow"}
+	if !equalOrder(r.order, want) {
+		t.Fatalf("order mismatch: got %v want %v", r.order, want)
+	}
+}
+
+func TestRunGraphParallelSingleWorkerOrder(t *testing.T) {
+	deps := map[TaskName][]TaskName{
+		"d": {"a"},
+		"c": {},
+		"b": {},
+		"a": {},
+	}
+	r := &recordRunner{}
+	if _, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []TaskName{"a", "b", "c", "d"}
+	if !equalOrder(r.order, want) {
+		t.Fatalf("order mismatch: got %v want %v", r.order, want)
+	}
+}
+
+type cancelRunner struct {
+	recordRunner
+	cancelled chan TaskName
+}
+
+func (r *cancelRunner) Run(ctx context.Context, name TaskName) error {
+	if err := r.recordRunner.Run(ctx, name); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		r.cancelled <- name
+		return ctx.Err()
+	case <-time.After(2 * time.Second):
+		return nil
+	}
+}
+
+func TestRunGraphParallelFailFastCancelsSiblings(t *testing.T) {
+	deps := map[TaskName][]TaskName{
+		"a": {},
+		"b": {},
+		"c": {"b"},
+	}
+	failure := errors.New("fail")
+	r := &cancelRunner{
+		recordRunner: recordRunner{errs: map[TaskName]error{"a": failure}},
+		cancelled:    make(chan TaskName, 1),
+	}
+	result, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2, Mode: FailFast})
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected task error, got %v", err)
+	}
+	select {
+	case name := <-r.cancelled:
+		if name != "b" {
+			t.Fatalf("expected b to be cancelled, got %s", name)
+		}
+	default:
+		t.Fatalf("expected running sibling to observe cancellation")
+	}
+	want := GraphResult{"a": StatusFailed, "b": StatusCancelled, "c": StatusSkipped}
+	if !equalResult(result, want) {
+		t.Fatalf("result mismatch: got %v want %v", result, want)
+	}
+}
+
+func TestRunGraphParallelFailStopLetsSiblingsFinish(t *testing.T) {
+	deps := map[TaskName][]TaskName{
+		"a": {},
+		"b": {},
+		"c": {"a", "b"},
+	}
+	r := &recordRunner{errs: map[TaskName]error{"a": errors.New("fail")}}
+	result, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	want := GraphResult{"a": StatusFailed, "b": StatusSucceeded, "c": StatusSkipped}
+	if !equalResult(result, want) {
+		t.Fatalf("result mismatch: got %v want %v", result, want)
+	}
+}
+
+func TestRunGraphParallelKeepGoing(t *testing.T) {
+	deps := map[TaskName][]TaskName{
+		"a":    {},
+		"b":    {},
+		"c":    {"a"},
+		"d":    {"b"},
+		"e":    {},
+		"last": {"c", "d", "e"},
+	}
+	errA := errors.New("a failed")
+	errE := errors.New("e failed")
+	r := &recordRunner{errs: map[TaskName]error{"a": errA, "e": errE}}
+	result, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 1, Mode: KeepGoing})
+	if !errors.Is(err, errA) || !errors.Is(err, errE) {
+		t.Fatalf("expected aggregated error, got %v", err)
+	}
+	want := []TaskName{"a", "b", "d", "e"}
+	if !equalOrder(r.order, want) {
+		t.Fatalf("order mismatch: got %v want %v", r.order, want)
+	}
+	wantResult := GraphResult{
+		"a":    StatusFailed,
+		"b":    StatusSucceeded,
+		"c":    StatusSkipped,
+		"d":    StatusSucceeded,
+		"e":    StatusFailed,
+		"last": StatusSkipped,
+	}
+	if !equalResult(result, wantResult) {
+		t.Fatalf("result mismatch: got %v want %v", result, wantResult)
+	}
+}
+
+func TestRunGraphParallelParentCancel(t *testing.T) {
+	deps := map[TaskName][]TaskName{
+		"b": {"a"},
+		"a": {},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &recordRunner{}
+	_, err := RunGraphParallel(ctx, r, deps, GraphOptions{MaxWorkers: 2})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(r.order) != 0 {
+		t.Fatalf("expected nothing to run, got %v", r.order)
+	}
+}
+
+func TestRunGraphParallelAllowedFailure(t *testing.T) {
+	deps := map[TaskName][]TaskName{
+		"a": {},
+		"b": {"a"},
+	}
+	r := &recordRunner{errs: map[TaskName]error{
+		"a": fmt.Errorf("%w: %w", ErrAllowedFailure, errors.New("flaky")),
+	}}
+	result, err := RunGraphParallel(context.Background(), r, deps, GraphOptions{MaxWorkers: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := GraphResult{"a": StatusAllowedFailure, "b": StatusSucceeded}
+	if !equalResult(result, want) {
+		t.Fatalf("result mismatch: got %v want %v", result, want)
+	}
+}
+
+func equalResult(got, want GraphResult) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for k, v := range want {
+		if got[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
 func equalOrder(got, want []TaskName) bool {
 	if len(got) != len(want) {
 		return false
@@ -3,6 +3,7 @@ package engine
 import (
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,6 +12,9 @@ import (
 	"github.com/pix-xip/weave/internal/events"
 )
 
+// progressBarWidth is the number of cells in a transfer progress bar.
+const progressBarWidth = 24
+
 type spinnerRenderer struct {
 	mu  sync.Mutex
 	ops map[string]*spinState
@@ -23,6 +27,9 @@ type spinState struct {
 	fps     time.Duration
 	index   int
 	stopped chan struct{}
+
+	// set once the transfer reports progress, guarded by the renderer's mu
+	progress map[string]any
 }
 
 func newSpinnerRenderer(out io.Writer) *spinnerRenderer {
@@ -38,17 +45,37 @@ func (r *spinnerRenderer) Handle(e events.Event) {
 		r.handleStart(e)
 	case events.OpEnd:
 		r.handleEnd(e)
+	case events.Progress:
+		r.handleProgress(e)
 	}
 }
 
-func (r *spinnerRenderer) handleStart(e events.Event) {
+// transferKey identifies a sync or fetch across its start, progress and
+// end events by op ID, falling back to the op and its paths for events
+// without one. ok is false for other ops.
+func transferKey(e events.Event) (key, label string, ok bool) {
 	op, _ := e.Fields["op"].(string)
 	if op != "sync" && op != "fetch" {
-		return
+		return "", "", false
+	}
+
+	label = fmt.Sprintf("%sing %s -> %s", op, strField(e.Fields, "src"), strField(e.Fields, "dst"))
+	if e.Task != "" {
+		label = e.Task + " | " + label
+	}
+
+	if e.OpID != "" {
+		return e.RunID + "/" + e.OpID, label, true
 	}
 
-	label := fmt.Sprintf("%sing %s -> %s", op, strField(e.Fields, "src"), strField(e.Fields, "dst"))
-	key := op + ":" + label
+	return op + ":" + label, label, true
+}
+
+func (r *spinnerRenderer) handleStart(e events.Event) {
+	key, label, ok := transferKey(e)
+	if !ok {
+		return
+	}
 
 	r.mu.Lock()
 
@@ -70,14 +97,25 @@ func (r *spinnerRenderer) handleStart(e events.Event) {
 	go r.run(state)
 }
 
-func (r *spinnerRenderer) handleEnd(e events.Event) {
-	op, _ := e.Fields["op"].(string)
-	if op != "sync" && op != "fetch" {
+func (r *spinnerRenderer) handleProgress(e events.Event) {
+	key, _, ok := transferKey(e)
+	if !ok {
 		return
 	}
 
-	label := fmt.Sprintf("%sing %s -> %s", op, strField(e.Fields, "src"), strField(e.Fields, "dst"))
-	key := op + ":" + label
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if state, ok := r.ops[key]; ok {
+		state.progress = e.Fields
+	}
+}
+
+func (r *spinnerRenderer) handleEnd(e events.Event) {
+	key, _, ok := transferKey(e)
+	if !ok {
+		return
+	}
 
 	r.mu.Lock()
 
@@ -90,7 +128,7 @@ func (r *spinnerRenderer) handleEnd(e events.Event) {
 	r.mu.Unlock()
 
 	if ok {
-		r.printf("\r%s done\n", state.label)
+		r.printf("\r\x1b[K%s done\n", state.label)
 	}
 }
 
@@ -103,13 +141,38 @@ func (r *spinnerRenderer) run(state *spinState) {
 		case <-state.stopped:
 			return
 		case <-ticker.C:
+			r.mu.Lock()
+			progress := state.progress
+			r.mu.Unlock()
+
+			if progress != nil {
+				r.printf("\r\x1b[K%s %s", state.label, progressLine(progress))
+				continue
+			}
+
 			frame := state.frames[state.index%len(state.frames)]
 			state.index++
-			r.printf("\r%s %s", state.label, frame)
+			r.printf("\r\x1b[K%s %s", state.label, frame)
 		}
 	}
 }
 
+// progressLine renders a progress event as a bar with the bytes copied, the
+// rate and the time left.
+func progressLine(fields map[string]any) string {
+	percent, _ := fields["percent"].(int)
+	bytes, _ := fields["bytes"].(int64)
+	rate, _ := fields["bytes_per_sec"].(int64)
+	eta, _ := fields["eta_ms"].(int64)
+
+	percent = min(max(percent, 0), 100)
+	filled := percent * progressBarWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+	return fmt.Sprintf("[%s] %3d%% %s %s/s ETA %s",
+		bar, percent, humanBytes(bytes), humanBytes(rate), time.Duration(eta)*time.Millisecond)
+}
+
 func (r *spinnerRenderer) printf(format string, args ...any) {
 	if r.out == nil {
 		return
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// controlPersist keeps an idle master alive between commands. Masters are
+// closed explicitly when a run ends, this only bounds how long one can
+// outlive a crashed weave process.
+const controlPersist = "5m"
+
+// muxCloseTimeout bounds how long tearing down a single master may take.
+const muxCloseTimeout = 5 * time.Second
+
+// maxSocketPath is the size of sun_path on macOS and the BSDs, the smallest
+// of the platforms ssh runs on. It includes the terminating NUL.
+const maxSocketPath = 104
+
+// controlSocketLen is the length of the socket path ssh binds in dir: the
+// %C hash plus the random suffix of the temporary name a master starts with.
+func controlSocketLen(dir string) int {
+	return len(filepath.Join(dir, "%C")) - len("%C") + 40 + len(".XXXXXXXXXXXXXXXX")
+}
+
+// sshMux shares one ssh ControlMaster connection per host across every
+// ctx:run and rsync transport of an Engine.Run.
+type sshMux struct {
+	dir     string
+	tempDir bool
+
+	mu    sync.Mutex
+	hosts map[string]HostConfig // by control key, hosts with a master to close
+}
+
+// newSSHMux prepares the control socket directory, creating a private
+// temporary one when dir is empty. It returns a nil mux, turning
+// multiplexing off, when the socket paths would be too long for ssh.
+func newSSHMux(dir string) (*sshMux, error) {
+	m := &sshMux{dir: dir, hosts: map[string]HostConfig{}}
+
+	if dir == "" {
+		// $TMPDIR on macOS is long enough on its own to overflow sun_path
+		root := ""
+		if info, err := os.Stat("/tmp"); err == nil && info.IsDir() {
+			root = "/tmp"
+		}
+
+		tmp, err := os.MkdirTemp(root, "weave-ssh-")
+		if err != nil {
+			return nil, err
+		}
+
+		m.dir = tmp
+		m.tempDir = true
+	} else if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	if controlSocketLen(m.dir) >= maxSocketPath {
+		log.Warn("ssh control dir path is too long for its sockets, connection sharing is off", "dir", m.dir)
+
+		if m.tempDir {
+			_ = os.RemoveAll(m.dir)
+		}
+
+		return nil, nil
+	}
+
+	return m, nil
+}
+
+// sshArgs returns the full set of ssh flags for host, including the
+// multiplexing options when the host allows it. A nil mux adds nothing.
+func (m *sshMux) sshArgs(host HostConfig) []string {
+	args := host.SSHArgs()
+	if m == nil || !host.Multiplex {
+		return args
+	}
+
+	m.mu.Lock()
+	m.hosts[host.Target()+" "+strings.Join(host.SSHArgs(), " ")] = host
+	m.mu.Unlock()
+
+	return append(args, m.controlArgs()...)
+}
+
+func (m *sshMux) controlArgs() []string {
+	return []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(m.dir, "%C"),
+		"-o", "ControlPersist=" + controlPersist,
+	}
+}
+
+// Close asks every master started during the run to exit and removes the
+// socket directory if it was created by newSSHMux.
+func (m *sshMux) Close() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	hosts := m.hosts
+	m.hosts = map[string]HostConfig{}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, host := range hosts {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// the run context may already be cancelled, teardown still has to happen
+			ctx, cancel := context.WithTimeout(context.Background(), muxCloseTimeout)
+			defer cancel()
+
+			args := append(host.SSHArgs(), m.controlArgs()...)
+			args = append(args, "-O", "exit", host.Target())
+
+			cmd := exec.CommandContext(ctx, "ssh", args...)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				log.Debug("closing ssh master", "host", host.Target(), "err", err, "output", string(out))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if m.tempDir {
+		if err := os.RemoveAll(m.dir); err != nil {
+			log.Debug("removing ssh control dir", "dir", m.dir, "err", err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSSHMuxControlPathLength(t *testing.T) {
+	mux, err := newSSHMux("")
+	if err != nil {
+		t.Fatalf("newSSHMux: %v", err)
+	}
+	if mux == nil {
+		t.Fatal("expected the default control dir to fit ssh's socket path limit")
+	}
+	defer mux.Close()
+
+	if n := controlSocketLen(mux.dir); n >= maxSocketPath {
+		t.Fatalf("default control socket path is %d bytes long", n)
+	}
+
+	// a macOS style $TMPDIR alone leaves too little room
+	long := filepath.Join(t.TempDir(), "folders", strings.Repeat("x", 60), "T")
+	mux, err = newSSHMux(long)
+	if err != nil {
+		t.Fatalf("newSSHMux: %v", err)
+	}
+	if mux != nil {
+		t.Fatalf("expected multiplexing to be off for %s", long)
+	}
+
+	if _, err := os.Stat(long); err != nil {
+		t.Fatalf("expected the configured dir to be created: %v", err)
+	}
+
+	if got := mux.sshArgs(HostConfig{Addr: "a", Multiplex: true}); len(got) != 0 {
+		t.Fatalf("unexpected ssh args without multiplexing: %v", got)
+	}
+}
@@ -0,0 +1,556 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	nativeConnectTimeout    = 30 * time.Second
+	nativeKeepaliveInterval = 30 * time.Second
+
+	// exitTransport mirrors the ssh binary's exit code for connection errors.
+	exitTransport = 255
+)
+
+// transportError is a failure to reach or talk to the host, as opposed to
+// the remote command exiting non-zero.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return "ssh transport: " + e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+func (e *transportError) ExitCode() int { return exitTransport }
+
+// remoteExitError reports a remote command's non-zero exit status.
+type remoteExitError struct {
+	err *ssh.ExitError
+}
+
+func (e *remoteExitError) Error() string { return e.err.Error() }
+func (e *remoteExitError) Unwrap() error { return e.err }
+func (e *remoteExitError) ExitCode() int { return e.err.ExitStatus() }
+
+// nativeTransport runs commands over golang.org/x/crypto/ssh, sharing one
+// client connection per host through pool.
+type nativeTransport struct {
+	host HostConfig
+	pool *sshClientPool
+}
+
+func (t nativeTransport) Run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	client, err := t.pool.client(ctx, t.host)
+	if err != nil {
+		return &transportError{err: err}
+	}
+
+	sess, err := client.NewSession()
+	if err != nil {
+		// the pooled connection may have died since it was last used, so
+		// give it one fresh connection before failing
+		t.pool.discard(t.host, client)
+
+		if client, err = t.pool.client(ctx, t.host); err == nil {
+			sess, err = client.NewSession()
+		}
+
+		if err != nil {
+			return &transportError{err: err}
+		}
+	}
+	defer sess.Close()
+
+	sess.Stdin = stdin
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+
+	if err := sess.Start(cmd); err != nil {
+		return &transportError{err: err}
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- sess.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = sess.Signal(ssh.SIGKILL)
+		_ = sess.Close()
+
+		<-done
+
+		return ctx.Err()
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if ee, ok := errors.AsType[*ssh.ExitError](err); ok {
+		return &remoteExitError{err: ee}
+	}
+
+	return &transportError{err: err}
+}
+
+// sshClientPool holds one native ssh connection per host for the lifetime
+// of an Engine.Run.
+type sshClientPool struct {
+	mu      sync.Mutex
+	entries map[string]*pooledClient
+}
+
+type pooledClient struct {
+	mu      sync.Mutex
+	client  *ssh.Client
+	closers []io.Closer // jump hosts and agent connections, closed last
+}
+
+func newSSHClientPool() *sshClientPool {
+	return &sshClientPool{entries: map[string]*pooledClient{}}
+}
+
+func (p *sshClientPool) entry(host HostConfig) *pooledClient {
+	key := host.Target() + " " + strings.Join(host.SSHArgs(), " ")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[key]
+	if !ok {
+		entry = &pooledClient{}
+		p.entries[key] = entry
+	}
+
+	return entry
+}
+
+func (p *sshClientPool) client(ctx context.Context, host HostConfig) (*ssh.Client, error) {
+	if p == nil {
+		return nil, errors.New("native transport is not available outside a run")
+	}
+
+	entry := p.entry(host)
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.client != nil {
+		return entry.client, nil
+	}
+
+	client, closers, err := dialNative(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.client = client
+	entry.closers = closers
+
+	go keepalive(client, keepaliveInterval(host))
+
+	// a connection that drops, or is closed by keepalive, is forgotten so
+	// the next op on the host dials again
+	go func() {
+		_ = client.Wait()
+
+		entry.reset(client)
+	}()
+
+	return client, nil
+}
+
+// discard closes client and removes it from the pool, if it is still the
+// pooled connection to host.
+func (p *sshClientPool) discard(host HostConfig, client *ssh.Client) {
+	p.entry(host).reset(client)
+}
+
+// reset closes client and its closers when it is the entry's connection,
+// leaving the entry empty.
+func (e *pooledClient) reset(client *ssh.Client) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.client != client {
+		return
+	}
+
+	_ = e.client.Close()
+
+	for i := len(e.closers) - 1; i >= 0; i-- {
+		_ = e.closers[i].Close()
+	}
+
+	e.client = nil
+	e.closers = nil
+}
+
+// Close shuts down every connection opened through the pool.
+func (p *sshClientPool) Close() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	entries := p.entries
+	p.entries = map[string]*pooledClient{}
+	p.mu.Unlock()
+
+	for _, entry := range entries {
+		entry.mu.Lock()
+		client := entry.client
+		entry.mu.Unlock()
+
+		if client != nil {
+			entry.reset(client)
+		}
+	}
+}
+
+// dialNative connects to host, hopping through any proxy_jump hosts first.
+func dialNative(ctx context.Context, host HostConfig) (*ssh.Client, []io.Closer, error) {
+	var (
+		via     *ssh.Client
+		closers []io.Closer
+	)
+
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			_ = closers[i].Close()
+		}
+	}
+
+	if host.ProxyJump != "" {
+		for hop := range strings.SplitSeq(host.ProxyJump, ",") {
+			jump := jumpHost(strings.TrimSpace(hop), host)
+
+			client, hopClosers, err := dialClient(ctx, via, jump)
+			closers = append(closers, hopClosers...)
+
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("jump host %s: %w", jump.Target(), err)
+			}
+
+			closers = append(closers, client)
+			via = client
+		}
+	}
+
+	client, hostClosers, err := dialClient(ctx, via, host)
+	closers = append(closers, hostClosers...)
+
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+
+	return client, closers, nil
+}
+
+func dialClient(ctx context.Context, via *ssh.Client, host HostConfig) (*ssh.Client, []io.Closer, error) {
+	cfg, closers, err := nativeClientConfig(host)
+	if err != nil {
+		return nil, closers, err
+	}
+
+	port := host.Port
+	if port == 0 {
+		port = 22
+	}
+
+	addr := net.JoinHostPort(host.Addr, strconv.Itoa(port))
+
+	dialCtx, cancel := context.WithTimeout(ctx, nativeConnectTimeout)
+	defer cancel()
+
+	var conn net.Conn
+
+	if via == nil {
+		var d net.Dialer
+		conn, err = d.DialContext(dialCtx, "tcp", addr)
+	} else {
+		conn, err = via.DialContext(dialCtx, "tcp", addr)
+	}
+
+	if err != nil {
+		return nil, closers, err
+	}
+
+	// bound the handshake too, ssh.NewClientConn takes no context
+	deadline, _ := dialCtx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, closers, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), closers, nil
+}
+
+func nativeClientConfig(host HostConfig) (*ssh.ClientConfig, []io.Closer, error) {
+	var (
+		auth    []ssh.AuthMethod
+		closers []io.Closer
+	)
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			closers = append(closers, conn)
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			log.Debug("ssh agent unavailable", "sock", sock, "err", err)
+		}
+	}
+
+	signers, err := identitySigners(host)
+	if err != nil {
+		return nil, closers, err
+	}
+
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if len(auth) == 0 {
+		return nil, closers, errors.New("no ssh agent or identity files available")
+	}
+
+	hostKeys, err := hostKeyCallback(host)
+	if err != nil {
+		return nil, closers, err
+	}
+
+	username := host.User
+	if username == "" {
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         nativeConnectTimeout,
+	}, closers, nil
+}
+
+// identitySigners loads the host's identity_file, or the usual default keys
+// when none is configured.
+func identitySigners(host HostConfig) ([]ssh.Signer, error) {
+	if host.IdentityFile != "" {
+		signer, err := loadSigner(host.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return []ssh.Signer{signer}, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil
+	}
+
+	var signers []ssh.Signer
+
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		signer, err := loadSigner(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+func loadSigner(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := errors.AsType[*ssh.PassphraseMissingError](err); ok {
+		return nil, fmt.Errorf("%s is passphrase protected, add it to ssh-agent instead", path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return signer, nil
+}
+
+// hostKeyCallback verifies host keys against known_hosts following the
+// host's strict_host_key_checking setting.
+func hostKeyCallback(host HostConfig) (ssh.HostKeyCallback, error) {
+	if host.StrictHostKeyChecking == "no" {
+		return ssh.InsecureIgnoreHostKey(), nil //nolint:gosec // explicitly requested by the host config
+	}
+
+	file := expandHome(host.SSHOptions["UserKnownHostsFile"])
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	acceptNew := host.StrictHostKeyChecking == "accept-new"
+
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) && acceptNew {
+		if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(file, nil, 0o600); err != nil {
+			return nil, err
+		}
+	}
+
+	known, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %w", err)
+	}
+
+	if !acceptNew {
+		return known, nil
+	}
+
+	var mu sync.Mutex
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+
+		ke, ok := errors.AsType[*knownhosts.KeyError](err)
+		if !ok || len(ke.Want) > 0 {
+			return err
+		}
+
+		// unknown host, remember it; changed keys are still rejected above
+		mu.Lock()
+		defer mu.Unlock()
+
+		f, ferr := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0o600)
+		if ferr != nil {
+			return ferr
+		}
+		defer f.Close()
+
+		_, ferr = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+
+		return ferr
+	}, nil
+}
+
+// jumpHost parses a proxy_jump hop of the form [user@]host[:port], taking
+// the identity and host key settings from the final host.
+func jumpHost(spec string, final HostConfig) HostConfig {
+	jump := final
+	jump.ProxyJump = ""
+	jump.Port = 0
+	jump.User = ""
+
+	if u, rest, ok := strings.Cut(spec, "@"); ok {
+		jump.User = u
+		spec = rest
+	}
+
+	jump.Addr = spec
+
+	if h, p, err := net.SplitHostPort(spec); err == nil {
+		if port, err := strconv.Atoi(p); err == nil {
+			jump.Addr = h
+			jump.Port = port
+		}
+	}
+
+	return jump
+}
+
+func keepaliveInterval(host HostConfig) time.Duration {
+	if v, ok := host.SSHOptions["ServerAliveInterval"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+	}
+
+	return nativeKeepaliveInterval
+}
+
+// keepalive pings the server until the connection closes, closing it early
+// if the server stops answering.
+func keepalive(client *ssh.Client, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		_ = client.Wait()
+
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			// a server that stops answering leaves SendRequest waiting for
+			// good, so the reply is only waited for until the next ping
+			reply := make(chan error, 1)
+
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+
+			select {
+			case <-closed:
+				return
+			case err := <-reply:
+				if err == nil {
+					continue
+				}
+			case <-time.After(interval):
+			}
+
+			_ = client.Close()
+
+			return
+		}
+	}
+}
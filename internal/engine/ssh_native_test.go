@@ -0,0 +1,394 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process stand-in for sshd that runs exec requests
+// with the local sh.
+type testSSHServer struct {
+	addr     string
+	hostKey  ssh.PublicKey
+	identity string // path to a client key the server accepts
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// dropConnections closes every connection accepted so far, as if the host
+// had gone away.
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+
+	s.conns = nil
+}
+
+func startTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("host signer: %v", err)
+	}
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("client key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatalf("marshal client key: %v", err)
+	}
+	identity := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(identity, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write client key: %v", err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatalf("client public key: %v", err)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	srv := &testSSHServer{
+		addr:     ln.Addr().String(),
+		hostKey:  hostSigner.PublicKey(),
+		identity: identity,
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+
+			go serveTestSSHConn(conn, cfg)
+		}
+	}()
+
+	return srv
+}
+
+func serveTestSSHConn(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go serveTestSSHSession(ch, chReqs)
+	}
+}
+
+func serveTestSSHSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var cmd *exec.Cmd
+
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Stdin = ch
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			go func() {
+				status := uint32(0)
+				if err := cmd.Run(); err != nil {
+					status = uint32(exitCode(err))
+				}
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				_ = ch.Close()
+			}()
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				_ = cmd.Process.Kill()
+			}
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// host returns a native transport HostConfig for the server, trusting its
+// key through a fresh known_hosts file unless knownHosts is false.
+func (s *testSSHServer) host(t *testing.T, knownHosts bool) HostConfig {
+	t.Helper()
+
+	h, p, _ := net.SplitHostPort(s.addr)
+	port, _ := strconv.Atoi(p)
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if knownHosts {
+		line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.hostKey)
+		if err := os.WriteFile(file, []byte(line+"\n"), 0o600); err != nil {
+			t.Fatalf("write known_hosts: %v", err)
+		}
+	}
+
+	return HostConfig{
+		Addr:         h,
+		Port:         port,
+		User:         "weave",
+		IdentityFile: s.identity,
+		Transport:    transportNative,
+		SSHOptions:   map[string]string{"UserKnownHostsFile": file},
+	}
+}
+
+func TestNativeTransportRun(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	srv := startTestSSHServer(t)
+	pool := newSSHClientPool()
+	defer pool.Close()
+
+	tr := nativeTransport{host: srv.host(t, true), pool: pool}
+
+	var stdout, stderr bytes.Buffer
+	err := tr.Run(context.Background(), "echo hi; echo oops >&2; exit 3", nil, &stdout, &stderr)
+	if code := exitCode(err); code != 3 {
+		t.Fatalf("expected exit 3, got %d (%v)", code, err)
+	}
+	if stdout.String() != "hi\n" || stderr.String() != "oops\n" {
+		t.Fatalf("unexpected output: %q %q", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	if err := tr.Run(context.Background(), "echo again", nil, &stdout, &stderr); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if len(pool.entries) != 1 {
+		t.Fatalf("expected a single pooled connection, got %d", len(pool.entries))
+	}
+}
+
+func TestNativeTransportReconnects(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	srv := startTestSSHServer(t)
+	pool := newSSHClientPool()
+	defer pool.Close()
+
+	tr := nativeTransport{host: srv.host(t, true), pool: pool}
+
+	for i := range 3 {
+		var stdout bytes.Buffer
+		if err := tr.Run(context.Background(), "echo up", nil, &stdout, io.Discard); err != nil || stdout.String() != "up\n" {
+			t.Fatalf("run %d: %v %q", i, err, stdout.String())
+		}
+
+		srv.dropConnections()
+
+		// the second drop is noticed by the pool before the next run
+		if i == 1 {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				entry := pool.entry(tr.host)
+				entry.mu.Lock()
+				gone := entry.client == nil
+				entry.mu.Unlock()
+
+				if gone {
+					break
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatal("the dropped connection stayed in the pool")
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestNativeTransportHostKeys(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	srv := startTestSSHServer(t)
+
+	host := srv.host(t, false)
+	err := nativeTransport{host: host, pool: newSSHClientPool()}.Run(context.Background(), "true", nil, &bytes.Buffer{}, &bytes.Buffer{})
+	if code := exitCode(err); code != exitTransport {
+		t.Fatalf("expected unknown host key to be rejected with %d, got %d (%v)", exitTransport, code, err)
+	}
+
+	host.StrictHostKeyChecking = "accept-new"
+	pool := newSSHClientPool()
+	defer pool.Close()
+
+	if err := (nativeTransport{host: host, pool: pool}).Run(context.Background(), "true", nil, &bytes.Buffer{}, &bytes.Buffer{}); err != nil {
+		t.Fatalf("accept-new run: %v", err)
+	}
+
+	data, err := os.ReadFile(host.SSHOptions["UserKnownHostsFile"])
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	if !strings.Contains(string(data), knownhosts.Normalize(srv.addr)) {
+		t.Fatalf("expected host to be recorded, got %q", data)
+	}
+}
+
+func TestNativeTransportFromWeavefile(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	srv := startTestSSHServer(t)
+	host := srv.host(t, true)
+
+	err := runWeavefile(t, `
+config = {
+  hosts = {
+    box = {
+      addr = "`+host.Addr+`",
+      port = `+strconv.Itoa(host.Port)+`,
+      identity_file = "`+host.IdentityFile+`",
+      transport = "native",
+      ssh_options = { UserKnownHostsFile = "`+host.SSHOptions["UserKnownHostsFile"]+`" },
+    },
+  },
+}
+
+task("remote", function(ctx)
+  local r = ctx:run("box", "printf '%s' \"$GREETING\"", { env = { GREETING = "hello" } })
+  assert(r.ok and r.out == "hello", "unexpected result: " .. r.out .. r.err)
+end)
+`, Options{}, "remote")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestKeepaliveClosesUnresponsiveConnection(t *testing.T) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("host signer: %v", err)
+	}
+
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		// global requests are never read, so keepalives get no reply
+		_, _, _, _ = ssh.NewServerConn(conn, cfg)
+	}()
+
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(clientConn, ln.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+
+	done := make(chan struct{})
+	go func() {
+		keepalive(client, 20*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("keepalive kept an unresponsive connection open")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the client to be closed")
+	}
+}
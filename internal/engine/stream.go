@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// lineWriter calls emit for every complete line written to it, holding back
+// a trailing partial line until more output arrives or Flush is called.
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	emit func(line string)
+}
+
+func newLineWriter(emit func(line string)) *lineWriter {
+	return &lineWriter{emit: emit}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.emit(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush emits any buffered partial line.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return
+	}
+
+	w.emit(strings.TrimSuffix(string(w.buf), "\r"))
+	w.buf = nil
+}
+
+// streamPrefix labels streamed output with the task and, for remote
+// commands, the host it came from.
+func streamPrefix(task, host string) string {
+	if host == "" {
+		return task
+	}
+
+	return task + "@" + host
+}
@@ -0,0 +1,429 @@
+package engine
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// File transfer methods accepted by a host's file_transfer option.
+const (
+	transferAuto  = "auto"  // rsync when it is installed, tar otherwise
+	transferRsync = "rsync" // always rsync
+	transferTar   = "tar"   // built-in tar stream over the host's transport
+)
+
+// transferMethod picks how ctx:sync and ctx:fetch copy files for host, which
+// is nil for local copies.
+func transferMethod(host *HostConfig) string {
+	if host != nil && host.FileTransfer != "" && host.FileTransfer != transferAuto {
+		return host.FileTransfer
+	}
+
+	if _, err := exec.LookPath("rsync"); err != nil {
+		return transferTar
+	}
+
+	return transferRsync
+}
+
+// remoteRsyncMissing reports whether an rsync run failed because the remote
+// end has no rsync installed.
+func remoteRsyncMissing(res cmdResult) bool {
+	return !res.ok() &&
+		(strings.Contains(res.stderr, "rsync: command not found") || strings.Contains(res.stderr, "rsync: not found"))
+}
+
+// checkTarOptions rejects the rsync options the tar transfer cannot honour.
+// The implicit delete of ctx:sync is simply not applied.
+func checkTarOptions(o rsyncOptions) error {
+	var unsupported []string
+
+	for name, set := range map[string]bool{
+		"delete":    o.delete != nil && *o.delete,
+		"exclude":   len(o.exclude) > 0,
+		"include":   len(o.include) > 0,
+		"gitignore": o.gitignore,
+		"checksum":  o.checksum,
+		"bwlimit":   o.bwlimit != "",
+		"chmod":     o.chmod != "",
+		"chown":     o.chown != "",
+		"dry_run":   o.dryRun,
+	} {
+		if set {
+			unsupported = append(unsupported, name)
+		}
+	}
+
+	if len(unsupported) == 0 {
+		return nil
+	}
+
+	slices.Sort(unsupported)
+
+	return fmt.Errorf("the tar file transfer does not support %s", strings.Join(unsupported, ", "))
+}
+
+// tarAttempt copies src to dst by streaming a tar archive, following rsync's
+// rules: a trailing slash on src copies the directory's contents, otherwise
+// the directory (or file) itself. Missing parent directories of dst are
+// created. At most one side is a remote host:path spec, run on host.
+func (c *Ctx) tarAttempt(src, dst string, host *HostConfig) attemptFunc {
+	return func(ctx context.Context, _, stderr io.Writer) error {
+		target, srcPath, srcRemote := splitHostPath(src)
+		if !srcRemote {
+			srcPath = src
+		}
+
+		dstTarget, dstPath, dstRemote := splitHostPath(dst)
+		if !dstRemote {
+			dstPath = dst
+		} else {
+			target = dstTarget
+		}
+
+		if !srcRemote && !dstRemote {
+			return copyLocalTar(srcPath, dstPath)
+		}
+
+		h := HostConfig{Addr: target, Multiplex: true}
+		if host != nil {
+			h = *host
+		}
+
+		tr := c.transport(h)
+
+		if srcRemote {
+			return tarDownload(ctx, tr, srcPath, dstPath, stderr)
+		}
+
+		return tarUpload(ctx, tr, srcPath, dstPath, stderr)
+	}
+}
+
+// tarUpload copies a local path to a remote one. Single files are streamed
+// as-is so they can be renamed on the way.
+func tarUpload(ctx context.Context, tr Transport, srcPath, dstPath string, stderr io.Writer) error {
+	contents := strings.HasSuffix(srcPath, "/")
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	dst := shellQuotePath(strings.TrimSuffix(dstPath, "/"))
+
+	if !info.IsDir() {
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// an existing directory receives the file, anything else is the
+		// file's new name
+		script := fmt.Sprintf(`if [ -d %[1]s ]; then f=%[1]s/%[2]s; else mkdir -p %[3]s && f=%[1]s || exit 1; fi; cat > "$f" && chmod %[4]o "$f"`,
+			dst, shellQuotePosix(filepath.Base(srcPath)), shellQuotePath(remoteDir(dstPath)), info.Mode().Perm())
+		if strings.HasSuffix(dstPath, "/") {
+			script = fmt.Sprintf(`mkdir -p %[1]s && cat > %[1]s/%[2]s && chmod %[3]o %[1]s/%[2]s`,
+				dst, shellQuotePosix(filepath.Base(srcPath)), info.Mode().Perm())
+		}
+
+		return tr.Run(ctx, "sh -c "+shellQuotePosix(script), f, io.Discard, stderr)
+	}
+
+	pr, pw := io.Pipe()
+	packed := make(chan error, 1)
+
+	go func() {
+		err := packTar(pw, srcPath, contents)
+		pw.CloseWithError(err)
+		packed <- err
+	}()
+
+	script := "mkdir -p " + dst + " && tar -C " + dst + " -xf -"
+	err = tr.Run(ctx, "sh -c "+shellQuotePosix(script), pr, io.Discard, stderr)
+
+	// unblock the packer if the remote end stopped reading early
+	pr.CloseWithError(errors.New("transfer aborted"))
+
+	if packErr := <-packed; packErr != nil && err == nil {
+		err = packErr
+	}
+
+	return err
+}
+
+// tarDownload copies a remote path to a local one.
+func tarDownload(ctx context.Context, tr Transport, srcPath, dstPath string, stderr io.Writer) error {
+	contents := strings.HasSuffix(srcPath, "/")
+	base := path.Base(strings.TrimSuffix(srcPath, "/"))
+
+	script := "cd " + shellQuotePath(strings.TrimSuffix(srcPath, "/")) + " && tar -cf - ."
+	if !contents {
+		script = "cd " + shellQuotePath(remoteDir(srcPath)) + " && tar -cf - " + shellQuotePosix(base)
+	}
+
+	pr, pw := io.Pipe()
+	unpacked := make(chan error, 1)
+
+	go func() {
+		err := unpackTar(pr, dstPath, contents, base)
+		if err == nil {
+			// tar pads the archive past its end marker
+			_, err = io.Copy(io.Discard, pr)
+		}
+
+		pr.CloseWithError(err)
+		unpacked <- err
+	}()
+
+	err := tr.Run(ctx, "sh -c "+shellQuotePosix(script), nil, pw, stderr)
+	pw.CloseWithError(err)
+
+	if unpackErr := <-unpacked; unpackErr != nil && err == nil {
+		err = unpackErr
+	}
+
+	return err
+}
+
+// copyLocalTar copies between two local paths with the same rules as the
+// remote transfers.
+func copyLocalTar(srcPath, dstPath string) error {
+	contents := strings.HasSuffix(srcPath, "/")
+	base := filepath.Base(srcPath)
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(packTar(pw, srcPath, contents))
+	}()
+
+	err := unpackTar(pr, dstPath, contents, base)
+	pr.CloseWithError(err)
+
+	return err
+}
+
+// remoteDir is the parent directory of a remote path, ignoring a trailing
+// slash.
+func remoteDir(p string) string {
+	return path.Dir(strings.TrimSuffix(p, "/"))
+}
+
+// shellQuotePath quotes a remote path, leaving a leading ~/ to the remote
+// shell so it still expands to the home directory.
+func shellQuotePath(p string) string {
+	if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		return `"$HOME"/` + shellQuotePosix(rest)
+	}
+
+	return shellQuotePosix(p)
+}
+
+// packTar writes src to w as a tar archive. With contents the entries are
+// relative to src, otherwise they sit under src's base name.
+func packTar(w io.Writer, src string, contents bool) error {
+	root := filepath.Clean(src)
+	base := filepath.Base(root)
+
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if !contents {
+			name = path.Join(base, name)
+		} else if name == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// unpackTar extracts an archive written by packTar, or by tar on a remote
+// host, into dst. A single file named base is written to dst itself unless
+// dst is a directory, matching how rsync renames a copied file.
+func unpackTar(r io.Reader, dst string, contents bool, base string) error {
+	dstIsDir := strings.HasSuffix(dst, "/")
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dstIsDir = true
+	}
+
+	dst = filepath.Clean(dst)
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			if err := mkdirAll(dst); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("tar entry %q escapes the destination", hdr.Name)
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		if !contents && !dstIsDir && name == base && hdr.Typeflag != tar.TypeDir {
+			target = dst
+		}
+
+		// a symlink in the destination, from an earlier entry or already
+		// there, must not carry later entries outside of it
+		if err := checkNoSymlinks(dst, target); err != nil {
+			return fmt.Errorf("tar entry %q: %w", hdr.Name, err)
+		}
+
+		if err := mkdirAll(filepath.Dir(target)); err != nil {
+			return err
+		}
+
+		// an existing symlink is replaced rather than written through
+		if info, err := os.Lstat(target); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		mode := fs.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0o700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeFile(target, tr, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			_ = os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkNoSymlinks returns an error if any directory between dst and target
+// is a symlink.
+func checkNoSymlinks(dst, target string) error {
+	rel, err := filepath.Rel(dst, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	dir := dst
+
+	for part := range strings.SplitSeq(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+
+		info, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", dir)
+		}
+	}
+
+	return nil
+}
+
+func writeFile(target string, r io.Reader, mode fs.FileMode) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Chmod(target, mode)
+}
@@ -0,0 +1,284 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeTree creates files under dir from a map of slash separated paths to
+// contents.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+
+		if err := os.WriteFile(p, []byte(data), 0o640); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+}
+
+// readTree returns every regular file under dir as slash separated paths
+// to contents.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	out := map[string]string{}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		data, err := os.ReadFile(p)
+		out[filepath.ToSlash(rel)] = string(data)
+
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walk %s: %v", dir, err)
+	}
+
+	return out
+}
+
+func equalTree(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestCopyLocalTarFollowsRsyncSlashRules(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"app/main.go": "main", "app/sub/x.txt": "x", "note.txt": "note"})
+
+	existing := filepath.Join(t.TempDir(), "existing")
+	if err := os.MkdirAll(existing, 0o750); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name, src, dst string
+		want           map[string]string
+	}{
+		{"contents", "app/", "out", map[string]string{"out/main.go": "main", "out/sub/x.txt": "x"}},
+		{"directory", "app", "out", map[string]string{"out/app/main.go": "main", "out/app/sub/x.txt": "x"}},
+		{"file renamed", "note.txt", "deep/renamed.txt", map[string]string{"deep/renamed.txt": "note"}},
+		{"file into dir", "note.txt", "deep/", map[string]string{"deep/note.txt": "note"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+
+			err := copyLocalTar(filepath.Join(src, tc.src)+suffix(tc.src), filepath.Join(root, tc.dst)+suffix(tc.dst))
+			if err != nil {
+				t.Fatalf("copyLocalTar: %v", err)
+			}
+
+			if got := readTree(t, root); !equalTree(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if err := copyLocalTar(filepath.Join(src, "note.txt"), existing); err != nil {
+		t.Fatalf("copyLocalTar: %v", err)
+	}
+
+	if got := readTree(t, existing); got["note.txt"] != "note" {
+		t.Fatalf("expected file inside existing directory, got %v", got)
+	}
+}
+
+// suffix keeps the trailing slash that filepath.Join drops.
+func suffix(p string) string {
+	if strings.HasSuffix(p, "/") {
+		return "/"
+	}
+
+	return ""
+}
+
+func TestUnpackTarRejectsEscapes(t *testing.T) {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Name: "../evil", Mode: 0o600, Size: 1, Typeflag: tar.TypeReg})
+	_, _ = tw.Write([]byte("x"))
+	_ = tw.Close()
+
+	if err := unpackTar(&buf, t.TempDir(), true, "x"); err == nil {
+		t.Fatal("expected an error for an entry outside the destination")
+	}
+
+	// an entry written through a symlink made earlier in the archive
+	outside := t.TempDir()
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Name: "a", Linkname: outside, Typeflag: tar.TypeSymlink})
+	_ = tw.WriteHeader(&tar.Header{Name: "a/passwd", Mode: 0o600, Size: 1, Typeflag: tar.TypeReg})
+	_, _ = tw.Write([]byte("x"))
+	_ = tw.Close()
+
+	if err := unpackTar(&buf, t.TempDir(), true, "x"); err == nil {
+		t.Fatal("expected an error for an entry written through a symlink")
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "passwd")); err == nil {
+		t.Fatal("the entry was written outside the destination")
+	}
+
+	// a symlink already in the destination is replaced, not followed
+	dst := t.TempDir()
+	target := filepath.Join(outside, "target")
+	writeTree(t, outside, map[string]string{"target": "keep"})
+
+	if err := os.Symlink(target, filepath.Join(dst, "file")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Name: "file", Mode: 0o600, Size: 3, Typeflag: tar.TypeReg})
+	_, _ = tw.Write([]byte("new"))
+	_ = tw.Close()
+
+	if err := unpackTar(&buf, dst, true, "x"); err != nil {
+		t.Fatalf("unpackTar: %v", err)
+	}
+
+	if got := readTree(t, outside)["target"]; got != "keep" {
+		t.Fatalf("the symlink target was overwritten with %q", got)
+	}
+
+	if info, err := os.Lstat(filepath.Join(dst, "file")); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected the symlink to be replaced by a file: %v", err)
+	}
+}
+
+func TestCheckTarOptions(t *testing.T) {
+	keep := false
+	if err := checkTarOptions(rsyncOptions{delete: &keep, progress: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := checkTarOptions(rsyncOptions{exclude: []string{"*.log"}, checksum: true})
+	if err == nil || err.Error() != "the tar file transfer does not support checksum, exclude" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTarTransferOverNativeTransport(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	srv := startTestSSHServer(t)
+	host := srv.host(t, true)
+
+	local := t.TempDir()
+	writeTree(t, local, map[string]string{"dist/index.html": "<h1>hi</h1>", "dist/js/app.js": "app()", "VERSION": "1.2.3"})
+
+	remote := t.TempDir()
+	fetched := t.TempDir()
+
+	t.Chdir(local)
+
+	err := runWeavefile(t, `
+config = {
+  hosts = {
+    box = {
+      addr = "`+host.Addr+`",
+      port = `+strconv.Itoa(host.Port)+`,
+      identity_file = "`+host.IdentityFile+`",
+      transport = "native",
+      file_transfer = "tar",
+      ssh_options = { UserKnownHostsFile = "`+host.SSHOptions["UserKnownHostsFile"]+`" },
+    },
+  },
+}
+
+task("copy", function(ctx)
+  local r = ctx:sync("dist/", "box:`+remote+`/site/www/")
+  assert(r.ok, "sync failed: " .. r.err)
+  r = ctx:sync("VERSION", "box:`+remote+`/release/version.txt")
+  assert(r.ok, "file sync failed: " .. r.err)
+  r = ctx:fetch("box:`+remote+`/site", "`+fetched+`/")
+  assert(r.ok, "fetch failed: " .. r.code .. r.err)
+
+  local ok, msg = pcall(function() ctx:sync("dist/", "box:/tmp/x", { exclude = { "*.map" }, check = true }) end)
+  assert(not ok and string.find(msg, "does not support exclude", 1, true), "expected unsupported option error: " .. tostring(msg))
+end)
+`, Options{}, "copy")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	want := map[string]string{
+		"site/www/index.html": "<h1>hi</h1>",
+		"site/www/js/app.js":  "app()",
+		"release/version.txt": "1.2.3",
+	}
+	if got := readTree(t, remote); !equalTree(got, want) {
+		t.Fatalf("unexpected remote tree %v", got)
+	}
+
+	want = map[string]string{"site/www/index.html": "<h1>hi</h1>", "site/www/js/app.js": "app()"}
+	if got := readTree(t, fetched); !equalTree(got, want) {
+		t.Fatalf("unexpected fetched tree %v", got)
+	}
+
+	info, err := os.Stat(filepath.Join(remote, "release/version.txt"))
+	if err != nil || info.Mode().Perm() != 0o640 {
+		t.Fatalf("expected file mode to be kept, got %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestSyncFallsBackToTarWithoutRemoteRsync(t *testing.T) {
+	fakeSSH(t)
+
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho 'sh: rsync: command not found' >&2\nexit 12\n"
+	if err := os.WriteFile(filepath.Join(bin, "rsync"), []byte(script), 0o700); err != nil {
+		t.Fatalf("write fake rsync: %v", err)
+	}
+
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	local := t.TempDir()
+	writeTree(t, local, map[string]string{"conf/app.toml": "port = 1"})
+
+	remote := t.TempDir()
+
+	err := runWeavefile(t, `
+config = { ssh_multiplex = false, hosts = { box = { addr = "box.example.com" } } }
+
+task("push", function(ctx)
+  local r = ctx:sync("`+local+`/conf", "box:`+remote+`/etc/")
+  assert(r.ok, "sync failed: " .. r.err)
+end)
+`, Options{}, "push")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if got := readTree(t, remote); !equalTree(got, map[string]string{"etc/conf/app.toml": "port = 1"}) {
+		t.Fatalf("unexpected remote tree %v", got)
+	}
+}
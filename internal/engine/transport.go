@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"context"
+	"io"
+)
+
+// Transport runs a command on a remote host for ctx:run and the tar file
+// transfer. cmd is handed to the remote user's shell as-is, stdin may be nil.
+type Transport interface {
+	Run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// Transport names accepted by a host's transport option.
+const (
+	transportSSH    = "ssh"    // shell out to the ssh binary
+	transportNative = "native" // built-in Go ssh client
+)
+
+// transport picks the Transport configured for host.
+func (c *Ctx) transport(host HostConfig) Transport {
+	if host.Transport == transportNative {
+		return nativeTransport{host: host, pool: c.clients}
+	}
+
+	return execTransport{host: host, mux: c.mux}
+}
+
+// execTransport runs commands through the system ssh binary, sharing a
+// multiplexed connection when mux is set.
+type execTransport struct {
+	host HostConfig
+	mux  *sshMux
+}
+
+func (t execTransport) Run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	args := append(t.mux.sshArgs(t.host), t.host.Target(), "--", cmd)
+
+	c := command(ctx, "ssh", args...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = stderr
+
+	return c.Run()
+}
+
+// exitCoder is implemented by errors that carry a process exit code, such
+// as *exec.ExitError and the native transport's errors.
+type exitCoder interface {
+	ExitCode() int
+}
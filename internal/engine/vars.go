@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// varPattern matches {{ name }} and {{ name.nested }} placeholders, and the
+// \{{ escape for a literal {{.
+var varPattern = regexp.MustCompile(`\\\{\{|\{\{\s*([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)\s*\}\}`)
+
+// hostVars returns the values placeholders can refer to for a host: its
+// vars, plus host, addr and user unless the vars set them.
+func hostVars(alias string, host HostConfig) map[string]any {
+	vars := map[string]any{
+		"host": alias,
+		"addr": host.Addr,
+		"user": host.User,
+	}
+	maps.Copy(vars, host.Vars)
+
+	return vars
+}
+
+// interpolate replaces every placeholder in s with its value from vars,
+// inserted as is, and \{{ with {{. A placeholder naming a table is an
+// error. One naming a missing var is an error when strict is set, and is
+// left as is otherwise, so that {{ end }} and the like survive in commands.
+func interpolate(s string, vars map[string]any, strict bool) (string, error) {
+	var err error
+
+	out := varPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if err != nil {
+			return m
+		}
+
+		if m == `\{{` {
+			return "{{"
+		}
+
+		name := varPattern.FindStringSubmatch(m)[1]
+
+		var v any = vars
+		for part := range strings.SplitSeq(name, ".") {
+			tbl, ok := v.(map[string]any)
+			if !ok {
+				v = nil
+				break
+			}
+
+			v = tbl[part]
+		}
+
+		if v == nil && !strict {
+			return m
+		}
+
+		var str string
+
+		str, err = formatVar(name, v)
+
+		return str
+	})
+
+	return out, err
+}
+
+func formatVar(name string, v any) (string, error) {
+	switch tv := v.(type) {
+	case string:
+		return tv, nil
+	case bool:
+		return strconv.FormatBool(tv), nil
+	case float64:
+		return strconv.FormatFloat(tv, 'f', -1, 64), nil
+	case nil:
+		return "", fmt.Errorf("unknown var %q", name)
+	default:
+		return "", fmt.Errorf("var %q is not a string, number or boolean", name)
+	}
+}
+
+// ctx:host("server") -> { name="server", addr="...", user="...", port=22, vars={...} }
+func (c *Ctx) luaHost(L *lua.LState) int {
+	name := L.CheckString(2)
+
+	host, ok := c.cfg.Hosts[name]
+	if !ok {
+		L.ArgError(2, "unknown host: "+name)
+		return 1
+	}
+
+	tbl := L.NewTable()
+	L.SetField(tbl, "name", lua.LString(name))
+	L.SetField(tbl, "addr", lua.LString(host.Addr))
+	L.SetField(tbl, "user", lua.LString(host.User))
+	L.SetField(tbl, "port", lua.LNumber(host.Port))
+
+	L.SetField(tbl, "vars", luaFromGo(L, host.Vars))
+	L.Push(tbl)
+
+	return 1
+}
@@ -0,0 +1,44 @@
+package engine
+
+import "testing"
+
+func TestInterpolate(t *testing.T) {
+	vars := hostVars("web1", HostConfig{
+		Addr: "10.0.1.1",
+		Vars: map[string]any{
+			"deploy_dir": "/srv/app",
+			"port":       float64(8080),
+			"db":         map[string]any{"name": "app"},
+		},
+	})
+
+	got, err := interpolate("cd {{ deploy_dir }} && ./run --port={{port}} --db={{ db.name }} # {{ host }}", vars, true)
+	if err != nil {
+		t.Fatalf("interpolate: %v", err)
+	}
+
+	if want := "cd /srv/app && ./run --port=8080 --db=app # web1"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if got, err := interpolate(`printf '\{{ .Name }} \{{ host }}' > {{ host }}.tmpl`, vars, true); err != nil ||
+		got != "printf '{{ .Name }} {{ host }}' > web1.tmpl" {
+		t.Fatalf("escaped placeholders: got %q, %v", got, err)
+	}
+
+	for _, s := range []string{"{{ missing }}", "{{ db }}", "{{ deploy_dir.x }}"} {
+		if _, err := interpolate(s, vars, true); err == nil {
+			t.Fatalf("expected error for %s", s)
+		}
+	}
+
+	// unknown names are left alone unless strict
+	if got, err := interpolate("{{ missing }} {{end}} {{ deploy_dir.x }} {{ port }}", vars, false); err != nil ||
+		got != "{{ missing }} {{end}} {{ deploy_dir.x }} 8080" {
+		t.Fatalf("lenient placeholders: got %q, %v", got, err)
+	}
+
+	if _, err := interpolate("{{ db }}", vars, false); err == nil {
+		t.Fatal("expected error for a table var")
+	}
+}
@@ -12,12 +12,16 @@ const (
 	OpStart   Type = "op_start"
 	OpEnd     Type = "op_end"
 	Message   Type = "message"
+	Output    Type = "output"
+	Progress  Type = "progress"
 )
 
 type Event struct {
 	Type   Type
 	Time   time.Time
-	Task   string
+	Task   string // the task that emitted the event
+	RunID  string // the Engine.Run the event belongs to
+	OpID   string // correlates the events of one ctx op, empty for task events
 	Fields map[string]any
 }
 
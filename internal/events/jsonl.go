@@ -0,0 +1,64 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// SchemaVersion is the version of the Record layout. It is only bumped for
+// changes that would break existing consumers, new event types and fields
+// are added without one.
+const SchemaVersion = 1
+
+// Record is the JSON Lines form of an Event.
+type Record struct {
+	Version int            `json:"v"`
+	Type    Type           `json:"type"`
+	Time    time.Time      `json:"time"`
+	RunID   string         `json:"run_id,omitempty"`
+	Task    string         `json:"task,omitempty"`
+	OpID    string         `json:"op_id,omitempty"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// JSONLWriter writes every event it handles to w as one Record per line.
+type JSONLWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	return &JSONLWriter{enc: json.NewEncoder(w)}
+}
+
+// Handle is a Handler for Bus.Subscribe. After the first failed write the
+// remaining events are dropped, see Err.
+func (j *JSONLWriter) Handle(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return
+	}
+
+	j.err = j.enc.Encode(Record{
+		Version: SchemaVersion,
+		Type:    e.Type,
+		Time:    e.Time,
+		RunID:   e.RunID,
+		Task:    e.Task,
+		OpID:    e.OpID,
+		Fields:  e.Fields,
+	})
+}
+
+// Err returns the first write error, if any.
+func (j *JSONLWriter) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.err
+}
@@ -0,0 +1,51 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := NewJSONLWriter(&buf)
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	w.Handle(Event{Type: TaskStart, Time: at, Task: "build", RunID: "r1", Fields: map[string]any{"task": "build"}})
+	w.Handle(Event{Type: OpEnd, Time: at, Task: "build", RunID: "r1", OpID: "1", Fields: map[string]any{"ok": true}})
+
+	want := `{"v":1,"type":"task_start","time":"2026-01-02T03:04:05Z","run_id":"r1","task":"build","fields":{"task":"build"}}
+{"v":1,"type":"op_end","time":"2026-01-02T03:04:05Z","run_id":"r1","task":"build","op_id":"1","fields":{"ok":true}}
+`
+	if buf.String() != want {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	var rec Record
+	if err := json.Unmarshal([]byte(strings.Split(buf.String(), "\n")[1]), &rec); err != nil || rec.OpID != "1" {
+		t.Fatalf("unexpected record %+v (%v)", rec, err)
+	}
+}
+
+type failWriter struct{ n int }
+
+func (f *failWriter) Write(p []byte) (int, error) {
+	f.n++
+	return 0, errors.New("disk full")
+}
+
+func TestJSONLWriterStopsAfterError(t *testing.T) {
+	fw := &failWriter{}
+	w := NewJSONLWriter(fw)
+
+	w.Handle(Event{Type: Message})
+	w.Handle(Event{Type: Message})
+
+	if w.Err() == nil || fw.n != 1 {
+		t.Fatalf("expected a single failed write, got %d writes and err %v", fw.n, w.Err())
+	}
+}
@@ -2,13 +2,17 @@
 
 config = {
 	hosts = {
-		server = { addr = "localhost", user = "pix" },
+		server = {
+			addr = "localhost",
+			user = "pix",
+			vars = { deploy_dir = "/home/pix/AdeptusCustodes/Lunar/Weave" },
+		},
 	},
 }
 
 task("sync-test", function(ctx)
-	ctx:log("info", "running sync test command", { host = config.hosts.server.addr })
-	local r = ctx:sync("./testfiles/syncfolder/", "server:/home/pix/AdeptusCustodes/Lunar/Weave/syncfolder/")
+	ctx:log("info", "running sync test command", { host = ctx:host("server").addr })
+	local r = ctx:sync("./testfiles/syncfolder/", "server:{{ deploy_dir }}/syncfolder/")
 	if not r.ok then
 		ctx:log("error", "sync failed", { err = r.err })
 		return
@@ -16,8 +20,8 @@ task("sync-test", function(ctx)
 end)
 
 task("fetch-test", { depends = { "sync-test" } }, function(ctx)
-	ctx:log("info", "running fetch test command", { host = config.hosts.server.addr })
-	local r = ctx:fetch("server:/home/pix/AdeptusCustodes/Lunar/Weave/syncfolder/", "./testfiles/fetchfolder/")
+	ctx:log("info", "running fetch test command", { host = ctx:host("server").addr })
+	local r = ctx:fetch("server:{{ deploy_dir }}/syncfolder/", "./testfiles/fetchfolder/")
 	if not r.ok then
 		ctx:log("error", "fetch failed", { err = r.err })
 		return
@@ -25,10 +29,10 @@ task("fetch-test", { depends = { "sync-test" } }, function(ctx)
 end)
 
 task("big-sync", function(ctx)
-	ctx:log("info", "running big sync test command", { host = config.hosts.server.addr })
+	ctx:log("info", "running big sync test command", { host = ctx:host("server").addr })
 	ctx:run("dd if=/dev/urandom of=./bigfile bs=1M count=500")
-	ctx:sync("./bigfile", "server:/home/pix/AdeptusCustodes/Lunar/Weave/bigfile_copy")
+	ctx:sync("./bigfile", "server:{{ deploy_dir }}/bigfile_copy")
 	ctx:run("rm ./bigfile")
-	ctx:run("server", "rm /home/pix/AdeptusCustodes/Lunar/Weave/bigfile_copy")
+	ctx:run("server", "rm {{ deploy_dir }}/bigfile_copy")
 	ctx:notify("Sync Done", "Bigfile Sync completed")
 end)
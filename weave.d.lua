@@ -1,13 +1,99 @@
+---@class WeaveResult
+---@field ok boolean
+---@field code integer
+---@field out string
+---@field err string
+---@field attempts integer
+---@field timed_out boolean
+
+---@class WeaveChange
+---@field path string
+---@field action "create"|"update"|"attrs"|"delete"
+---@field kind "file"|"dir"|"symlink"|"device"|"special"
+---@field flags string
+
+---@class WeaveSyncResult: WeaveResult
+---@field changes? WeaveChange[] only with dry_run = true
+
+---@class WeaveFileResult: WeaveResult
+---@field changed boolean
+---@field diff string unified diff of the old and new contents
+
+---@class WeaveHostResult: WeaveResult
+---@field skipped boolean
+
+---@class WeaveGroupResult
+---@field ok boolean
+---@field failed integer
+---@field skipped integer
+---@field hosts table<string, WeaveHostResult>
+
+---@class WeaveHost
+---@field name string
+---@field addr string
+---@field user string
+---@field port integer
+---@field vars table<string, any>
+
+---@class WeaveOpOpts
+---@field timeout? string|number
+---@field retries? integer
+---@field backoff? string|number
+---@field stream? boolean
+---@field check? boolean
+---@field env? table<string, string|number|boolean> ctx:run only
+---@field cwd? string ctx:run only
+---@field interpolate? boolean ctx:run, ctx:sync/fetch and file ops, defaults to true
+---@field parallel? integer ctx:run on a @group only
+---@field batch? integer ctx:run on a @group only
+---@field max_failures? integer ctx:run on a @group only
+---@field delete? boolean ctx:sync/fetch only, defaults to true for sync and false for fetch
+---@field exclude? string[] ctx:sync/fetch only
+---@field include? string[] ctx:sync/fetch only
+---@field gitignore? boolean ctx:sync/fetch only
+---@field checksum? boolean ctx:sync/fetch only
+---@field bwlimit? string|number ctx:sync/fetch only
+---@field chmod? string ctx:sync/fetch only
+---@field chown? string ctx:sync/fetch only
+---@field dry_run? boolean ctx:sync/fetch and file writes only
+---@field progress? boolean ctx:sync/fetch only, defaults to true with rsync 3.1 or newer
+---@field mode? string file writes only, octal such as "0644"
+---@field owner? string file writes only, "user" or "user:group"
+---@field engine? "go"|"interpolate" ctx:template only, defaults to "go"
+
+---@class WeaveParam
+---@field type? "string"|"number"|"bool"
+---@field required? boolean
+---@field default? string|number|boolean
+---@field help? string
+
 ---@class WeaveCtx
----@field run fun(self: WeaveCtx, cmd: string): { ok: boolean, code: integer, out: string, err: string }
----@field run fun(self: WeaveCtx, host: string, cmd: string): { ok: boolean, code: integer, out: string, err: string }
----@field sync fun(self: WeaveCtx, src: string, dst: string): { ok: boolean, code: integer, out: string, err: string }
----@field fetch fun(self: WeaveCtx, src: string, dst: string): { ok: boolean, code: integer, out: string, err: string }
+---@field params table<string, string|number|boolean>
+---@field args string[]
+---@field run fun(self: WeaveCtx, cmd: string, opts?: WeaveOpOpts): WeaveResult
+---@field run fun(self: WeaveCtx, host: string, cmd: string, opts?: WeaveOpOpts): WeaveResult|WeaveGroupResult
+---@field sync fun(self: WeaveCtx, src: string, dst: string, opts?: WeaveOpOpts): WeaveSyncResult
+---@field fetch fun(self: WeaveCtx, src: string, dst: string, opts?: WeaveOpOpts): WeaveSyncResult
+---@field put fun(self: WeaveCtx, src: string, dst: string, opts?: WeaveOpOpts): WeaveFileResult
+---@field get fun(self: WeaveCtx, src: string, dst: string, opts?: WeaveOpOpts): WeaveFileResult
+---@field template fun(self: WeaveCtx, src: string, dst: string, vars?: table<string, any>, opts?: WeaveOpOpts): WeaveFileResult
+---@field write_file fun(self: WeaveCtx, path: string, content: string, opts?: WeaveOpOpts): WeaveFileResult
+---@field read_file fun(self: WeaveCtx, path: string, opts?: WeaveOpOpts): string
+---@field host fun(self: WeaveCtx, name: string): WeaveHost
 ---@field log fun(self: WeaveCtx, level: string, msg: string, fields?: table): nil
 ---@field notify fun(self: WeaveCtx, title: string, message: string): nil
 
 ---@alias TaskFn fun(ctx: WeaveCtx): nil
----@alias TaskOpts { depends?: string[], help?: string}
+---@class TaskOpts
+---@field depends? string[]
+---@field help? string
+---@field timeout? string|number
+---@field retries? integer
+---@field allow_failure? boolean
+---@field params? table<string, WeaveParam>
+---@field env? table<string, string|number|boolean>
+---@field inputs? string[] globs relative to the Weavefile
+---@field outputs? string[] globs relative to the Weavefile
 
 ---@overload fun(name: string, fn: TaskFn)
 ---@overload fun(name: string, opts: TaskOpts, fn: TaskFn)